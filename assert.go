@@ -0,0 +1,293 @@
+package dbtesting
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AssertCount fails the test unless query, which should select a single count, returns want, e.g.
+// t.AssertCount(`SELECT count(*) FROM films WHERE did = $1`, 2, did).
+func (t *T) AssertCount(query string, want int, args ...interface{}) {
+	t.Helper()
+
+	var got int
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	if err := t.Tx.QueryRowContext(ctx, query, args...).Scan(&got); err != nil {
+		t.Fatalf("AssertCount: %q with args %v: %v", query, args, err)
+	}
+	if got != want {
+		t.Fatalf("AssertCount: %q with args %v returned %d, expected %d", query, args, got, want)
+	}
+}
+
+// Eventually polls query, which should select a single count, until it returns want, failing the test with the last
+// count seen once timeout has elapsed. It runs on the database rather than the test's transaction, so it sees what's
+// been committed by the code under test, e.g. a background worker, but none of the test's own uncommitted changes.
+func (t *T) Eventually(query string, want int, timeout time.Duration, args ...interface{}) {
+	t.Helper()
+
+	db := t.root().db
+	deadline := time.Now().Add(timeout)
+	for {
+		var got int
+		ctx, cncl := t.helperCtx()
+		err := db.QueryRowContext(ctx, query, args...).Scan(&got)
+		cncl()
+		if err != nil {
+			t.Fatalf("Eventually: %q with args %v: %v", query, args, err)
+		}
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Eventually: %q with args %v still returned %d after %v, expected %d", query, args, got, timeout, want)
+		}
+
+		select {
+		case <-t.Ctx.Done():
+			t.Fatalf("Eventually: %q with args %v returned %d, expected %d: %v", query, args, got, want, t.Ctx.Err())
+		case <-time.After(eventuallyInterval):
+		}
+	}
+}
+
+// AssertSameResults fails the test with a diff unless queryA and queryB return the same rows in the same order, e.g.
+// to check that a rewritten query is equivalent to the original. Values are compared as formatted by Golden, so that
+// an int64 matches the same number scanned as []byte; column names aren't compared.
+func (t *T) AssertSameResults(queryA, queryB string, argsA, argsB []interface{}) {
+	t.Helper()
+	t.assertSameResults("AssertSameResults", queryA, queryB, argsA, argsB, false)
+}
+
+// AssertSameResultsUnordered is like AssertSameResults but ignores the order of the rows.
+func (t *T) AssertSameResultsUnordered(queryA, queryB string, argsA, argsB []interface{}) {
+	t.Helper()
+	t.assertSameResults("AssertSameResultsUnordered", queryA, queryB, argsA, argsB, true)
+}
+
+func (t *T) assertSameResults(caller, queryA, queryB string, argsA, argsB []interface{}, unordered bool) {
+	t.Helper()
+
+	_, a, err := t.resultLines(queryA, argsA...)
+	if err != nil {
+		t.Fatalf("%v: %q with args %v: %v", caller, queryA, argsA, err)
+	}
+	_, b, err := t.resultLines(queryB, argsB...)
+	if err != nil {
+		t.Fatalf("%v: %q with args %v: %v", caller, queryB, argsB, err)
+	}
+	if unordered {
+		sort.Strings(a)
+		sort.Strings(b)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("%v: results of %q differ from %q:\n%v", caller, queryB, queryA, diffLines(strings.Join(a, "\n"), strings.Join(b, "\n")))
+	}
+}
+
+// AssertNoWrites fails the test if running f changes any row of tables, as seen by the test's transaction, e.g. to
+// check that supposedly read only code doesn't write. Every row of each table is compared, so that updates are caught
+// as well as inserts and deletes.
+func (t *T) AssertNoWrites(tables []string, f func()) {
+	t.Helper()
+
+	for _, w := range t.writes("AssertNoWrites", tables, f) {
+		t.Errorf("AssertNoWrites: %v", w)
+	}
+}
+
+// writes runs f, describing how each of tables changed as a result.
+func (t *T) writes(caller string, tables []string, f func()) []string {
+	t.Helper()
+
+	before := make([][]string, len(tables))
+	for i, table := range tables {
+		before[i] = t.tableLines(caller, table)
+	}
+	f()
+	var writes []string
+	for i, table := range tables {
+		if after := t.tableLines(caller, table); !reflect.DeepEqual(before[i], after) {
+			writes = append(writes, fmt.Sprintf("%v changed:\n%v", table, diffLines(strings.Join(before[i], "\n"), strings.Join(after, "\n"))))
+		}
+	}
+	return writes
+}
+
+// tableLines returns every row of table, formatted and sorted so that they can be compared regardless of order.
+func (t *T) tableLines(caller, table string) []string {
+	t.Helper()
+
+	_, lines, err := t.resultLines("SELECT * FROM " + table)
+	if err != nil {
+		t.Fatalf("%v: %v: %v", caller, table, err)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Checksum returns a hash of every row of table, as seen by the test's transaction, which is the same whatever order
+// they come back in, e.g. to compare before and after a test to find which tables it changed. On Postgres the hash is
+// computed by the database, so that the rows needn't be read; elsewhere it's of the sorted rows as formatted by Golden.
+// Checksums are only comparable with others from the same driver.
+func (t *T) Checksum(table string) string {
+	t.Helper()
+
+	if t.Driver() == dialectPostgres {
+		var sum string
+		ctx, cncl := t.helperCtx()
+		defer cncl()
+		q := "SELECT md5(coalesce(string_agg(x::text, E'\\n' ORDER BY x::text), '')) FROM " + table + " x"
+		if err := t.Tx.QueryRowContext(ctx, q).Scan(&sum); err != nil {
+			t.Fatalf("Checksum: %v: %v", table, err)
+		}
+		return sum
+	}
+
+	h := sha256.New()
+	for _, l := range t.tableLines("Checksum", table) {
+		h.Write([]byte(l))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AssertRow fails the test unless at least one row in table has the given column values, e.g.
+// t.AssertRow("films", map[string]interface{}{"code": "abcde", "title": "first"}). A nil value matches NULL.
+func (t *T) AssertRow(table string, match map[string]interface{}) {
+	t.Helper()
+
+	if n := t.countMatching("AssertRow", table, match); n == 0 {
+		t.Fatalf("AssertRow: no row in %v with %v", table, describeMatch(match))
+	}
+}
+
+// AssertOneRow is like AssertRow but also fails if more than one row matches.
+func (t *T) AssertOneRow(table string, match map[string]interface{}) {
+	t.Helper()
+
+	if n := t.countMatching("AssertOneRow", table, match); n != 1 {
+		t.Fatalf("AssertOneRow: %d rows in %v with %v, expected 1", n, table, describeMatch(match))
+	}
+}
+
+func (t *T) countMatching(caller, table string, match map[string]interface{}) int {
+	t.Helper()
+
+	query, args := countQuery(t.state.Driver, table, match)
+	var n int
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	if err := t.Tx.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		t.Fatalf("%v: %q with args %v: %v", caller, query, args, err)
+	}
+	return n
+}
+
+func countQuery(dialect, table string, match map[string]interface{}) (string, []interface{}) {
+	conds := make([]string, 0, len(match))
+	args := make([]interface{}, 0, len(match))
+	for _, c := range sortedColumns(match) {
+		if match[c] == nil {
+			conds = append(conds, c+" IS NULL")
+			continue
+		}
+		args = append(args, match[c])
+		conds = append(conds, c+" = "+placeholder(dialect, len(args)))
+	}
+
+	query := "SELECT count(*) FROM " + table
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return query, args
+}
+
+func describeMatch(match map[string]interface{}) string {
+	parts := make([]string, 0, len(match))
+	for _, c := range sortedColumns(match) {
+		if match[c] == nil {
+			parts = append(parts, c+" IS NULL")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%v = %#v", c, match[c]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// AssertJSON fails the test unless query, which should select a single JSON value, returns a value equal to want,
+// ignoring key order and whitespace. Mismatches are reported by their path within the value.
+func (t *T) AssertJSON(query string, args []interface{}, want string) {
+	t.Helper()
+
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+
+	var raw []byte
+	if err := t.Tx.QueryRowContext(ctx, query, args...).Scan(&raw); err != nil {
+		t.Fatalf("AssertJSON: %q with args %v: %v", query, args, err)
+	}
+
+	var gotV, wantV interface{}
+	if err := json.Unmarshal(raw, &gotV); err != nil {
+		t.Fatalf("AssertJSON: %q with args %v returned invalid JSON: %v", query, args, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantV); err != nil {
+		t.Fatalf("AssertJSON: invalid expected JSON: %v", err)
+	}
+	if diffs := diffJSON("$", wantV, gotV, nil); len(diffs) > 0 {
+		t.Fatalf("AssertJSON: %q with args %v returned %s, which differs from the expected JSON:\n%v",
+			query, args, raw, strings.Join(diffs, "\n"))
+	}
+}
+
+func diffJSON(path string, want, got interface{}, diffs []string) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, k := range sortedColumns(w) {
+			if _, ok := g[k]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%v.%v: missing", path, k))
+				continue
+			}
+			diffs = diffJSON(path+"."+k, w[k], g[k], diffs)
+		}
+		for _, k := range sortedColumns(g) {
+			if _, ok := w[k]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%v.%v: unexpected %v", path, k, formatJSON(g[k])))
+			}
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		if len(w) != len(g) {
+			return append(diffs, fmt.Sprintf("%v: expected %d elements but got %d", path, len(w), len(g)))
+		}
+		for i := range w {
+			diffs = diffJSON(fmt.Sprintf("%v[%d]", path, i), w[i], g[i], diffs)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(want, got) {
+		diffs = append(diffs, fmt.Sprintf("%v: expected %v but got %v", path, formatJSON(want), formatJSON(got)))
+	}
+	return diffs
+}
+
+func formatJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
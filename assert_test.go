@@ -0,0 +1,125 @@
+package dbtesting_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestAssertCount(t *testing.T) {
+	t.Run("count", dbtesting.Inject(func(t *dbtesting.T) {
+		t.AssertCount(`SELECT count(*) FROM films;`, 0)
+
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1), ('fghij', 'title', 2);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.AssertCount(`SELECT count(*) FROM films;`, 2)
+		t.AssertCount(`SELECT count(*) FROM films WHERE did = $1;`, 1, 2)
+	}))
+}
+
+func TestEventually(t *testing.T) {
+	t.Run("eventually", dbtesting.Inject(func(t *dbtesting.T) {
+		ready := time.Now().Add(200 * time.Millisecond)
+		t.Eventually(`SELECT CASE WHEN clock_timestamp() > $1 THEN 1 ELSE 0 END;`, 1, 5*time.Second, ready)
+	}))
+}
+
+func TestAssertSameResults(t *testing.T) {
+	t.Run("same", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1), ('fghij', 'second', 2);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.AssertSameResults(
+			`SELECT code, did FROM films WHERE did > $1 ORDER BY code;`,
+			`SELECT code, did::bigint FROM films WHERE title IN ($1, $2) ORDER BY code;`,
+			[]interface{}{0},
+			[]interface{}{"first", "second"},
+		)
+		t.AssertSameResultsUnordered(
+			`SELECT code FROM films ORDER BY code;`,
+			`SELECT code FROM films ORDER BY code DESC;`,
+			nil,
+			nil,
+		)
+	}))
+}
+
+func TestAssertNoWrites(t *testing.T) {
+	t.Run("no writes", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.AssertNoWrites([]string{"films"}, func() {
+			t.AssertCount(`SELECT count(*) FROM films;`, 1)
+		})
+	}))
+}
+
+func TestChecksum(t *testing.T) {
+	t.Run("checksum", dbtesting.Inject(func(t *dbtesting.T) {
+		empty := t.Checksum("films")
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1), ('fghij', 'second', 2);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+		one := t.Checksum("films")
+		if one == empty {
+			t.Fatalf("checksum %v unchanged by insert", one)
+		}
+		if again := t.Checksum("films"); again != one {
+			t.Fatalf("checksum changed from %v to %v without writes", one, again)
+		}
+
+		if _, err := t.Tx.ExecContext(t.Ctx, `UPDATE films SET title = 'changed' WHERE code = 'abcde';`); err != nil {
+			t.Fatalf("error updating: %v", err)
+		}
+		if t.Checksum("films") == one {
+			t.Fatal("checksum unchanged by update")
+		}
+	}))
+}
+
+func TestGolden(t *testing.T) {
+	t.Run("films", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('fghij', 'second', 2), ('abcde', 'first', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.Golden("films", `SELECT code, title, did, date_prod FROM films ORDER BY code;`)
+	}))
+}
+
+func TestAssertRow(t *testing.T) {
+	t.Run("row", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1), ('fghij', 'title', 2);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.AssertRow("films", map[string]interface{}{"title": "title"})
+		t.AssertOneRow("films", map[string]interface{}{"code": "abcde", "title": "title", "date_prod": nil})
+	}))
+}
+
+func TestDump(t *testing.T) {
+	t.Run("films", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.Dump("films")
+	}))
+}
+
+func TestAssertJSON(t *testing.T) {
+	t.Run("jsonb", dbtesting.Inject(func(t *dbtesting.T) {
+		t.AssertJSON(
+			`SELECT jsonb_build_object('code', $1::text, 'tags', jsonb_build_array(1, 2), 'kind', NULL);`,
+			[]interface{}{"abcde"},
+			`{"kind": null, "tags": [1, 2], "code": "abcde"}`,
+		)
+	}))
+}
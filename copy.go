@@ -0,0 +1,94 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// copyBatchSize is the number of rows inserted per statement when COPY isn't available.
+const copyBatchSize = 100
+
+// CopyRows returns a SetUpFunc which loads rows into the columns of table in a single transaction. With lib/pq it uses
+// COPY, which is much faster than inserting row by row; with other drivers the rows are inserted in batches.
+func CopyRows(table string, columns []string, rows [][]interface{}) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for i, row := range rows {
+			if len(row) != len(columns) {
+				return fmt.Errorf("row %d has %d values for %d columns", i, len(row), len(columns))
+			}
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		if usesPQ(db) {
+			err = copyIn(ctx, tx, table, columns, rows)
+		} else {
+			err = insertBatches(ctx, tx, dialectOf(db), table, columns, rows)
+		}
+		if err != nil {
+			return fmt.Errorf("loading %v: %w", table, err)
+		}
+		return tx.Commit()
+	}
+}
+
+func usesPQ(db *sql.DB) bool {
+	typ := reflect.TypeOf(db.Driver())
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return strings.HasSuffix(typ.PkgPath(), "lib/pq")
+}
+
+// copyIn follows lib/pq's protocol for COPY: each row is executed against the prepared statement, which is then
+// flushed by executing it without arguments.
+func copyIn(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("COPY %v (%v) FROM STDIN", table, strings.Join(columns, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func insertBatches(ctx context.Context, tx *sql.Tx, dialect, table string, columns []string, rows [][]interface{}) error {
+	for start := 0; start < len(rows); start += copyBatchSize {
+		end := start + copyBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for _, row := range rows[start:end] {
+			params := make([]string, len(row))
+			for i, v := range row {
+				args = append(args, v)
+				params[i] = placeholder(dialect, len(args))
+			}
+			values = append(values, "("+strings.Join(params, ", ")+")")
+		}
+
+		query := fmt.Sprintf("INSERT INTO %v (%v) VALUES %v", table, strings.Join(columns, ", "), strings.Join(values, ", "))
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("rows %d to %d: %w", start, end-1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// totalQueries counts the statements executed on connections opened under Config.CountQueries.
+var totalQueries int64
+
+// TotalQueries returns the number of statements executed on any of the database's connections since the test body
+// began, e.g. by code under test with connections of its own, which T.Queries misses. It requires
+// Config.CountQueries. Those run by this package's helpers, like AssertCount, and by tests running in parallel are
+// counted too.
+func (t *T) TotalQueries() int {
+	t.Helper()
+	return queriesSince(t.T, t.state, t.root().queriesBefore)
+}
+
+// TotalQueries is like T.TotalQueries.
+func (t *TDB) TotalQueries() int {
+	t.Helper()
+	return queriesSince(t.T, &state, t.queriesBefore)
+}
+
+func queriesSince(t *testing.T, s *settings, before int64) int {
+	t.Helper()
+
+	if !s.CountQueries {
+		t.Fatal("TotalQueries: requires Config.CountQueries")
+	}
+	return int(atomic.LoadInt64(&totalQueries) - before)
+}
+
+// wrappingConnector wraps the connections it opens, to count the statements executed on them in totalQueries under
+// Config.CountQueries, to record those of tests' transactions for T.Queries and to track the connections
+// Config.AfterConnect has been applied to.
+type wrappingConnector struct {
+	driver.Connector
+	counting bool
+}
+
+func (c wrappingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedConn{Conn: conn, counting: c.counting}, nil
+}
+
+// dsnConnector connects to a DSN with a driver which doesn't implement driver.DriverContext.
+type dsnConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.drv }
+
+// wrappedConn passes everything through to the wrapped connection, falling back as database/sql itself would where
+// the connection lacks an optional interface.
+type wrappedConn struct {
+	driver.Conn
+	counting bool
+	// prepared is set once Config.AfterConnect has been applied, which database/sql serializes with other uses
+	prepared bool
+	// rec records the statements of the test's transaction open on the connection, if any
+	rec *Tx
+}
+
+var (
+	_ driver.ExecerContext      = (*wrappedConn)(nil)
+	_ driver.QueryerContext     = (*wrappedConn)(nil)
+	_ driver.ConnPrepareContext = (*wrappedConn)(nil)
+	_ driver.ConnBeginTx        = (*wrappedConn)(nil)
+	_ driver.Pinger             = (*wrappedConn)(nil)
+	_ driver.SessionResetter    = (*wrappedConn)(nil)
+	_ driver.Validator          = (*wrappedConn)(nil)
+	_ driver.NamedValueChecker  = (*wrappedConn)(nil)
+)
+
+func (c *wrappedConn) count() {
+	if c.counting {
+		atomic.AddInt64(&totalQueries, 1)
+	}
+}
+
+func (c *wrappedConn) record(ctx context.Context, query string) {
+	if c.rec != nil && ctx.Value(unrecordedKey{}) == nil {
+		c.rec.record(query)
+	}
+}
+
+func (c *wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		// database/sql then prepares it, which is counted
+		return nil, driver.ErrSkip
+	}
+	res, err := e.ExecContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		c.count()
+		c.record(ctx, query)
+	}
+	return res, err
+}
+
+func (c *wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := q.QueryContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		c.count()
+		c.record(ctx, query)
+	}
+	return rows, err
+}
+
+func (c *wrappedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrappedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err == nil {
+		c.record(ctx, query)
+	}
+	if err != nil || !c.counting {
+		return stmt, err
+	}
+	return countingStmt{stmt, c.Conn}, nil
+}
+
+func (c *wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("dbtesting: driver does not support non-default transaction options")
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := ctx.Value(recorderKey{}).(*Tx)
+	if !ok {
+		return tx, nil
+	}
+	c.rec = rec
+	return recordedTx{tx, c}, nil
+}
+
+// recordedTx stops its connection recording once the test's transaction ends.
+type recordedTx struct {
+	driver.Tx
+	conn *wrappedConn
+}
+
+func (tx recordedTx) Commit() error {
+	tx.conn.rec = nil
+	return tx.Tx.Commit()
+}
+
+func (tx recordedTx) Rollback() error {
+	tx.conn.rec = nil
+	return tx.Tx.Rollback()
+}
+
+func (c *wrappedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *wrappedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	// database/sql then converts it by default
+	return driver.ErrSkip
+}
+
+// countingStmt counts each execution of a prepared statement.
+type countingStmt struct {
+	driver.Stmt
+	conn driver.Conn
+}
+
+func (s countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	atomic.AddInt64(&totalQueries, 1)
+	return s.Stmt.Exec(args)
+}
+
+func (s countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt64(&totalQueries, 1)
+	return s.Stmt.Query(args)
+}
+
+func (s countingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&totalQueries, 1)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s countingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&totalQueries, 1)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(values)
+}
+
+func (s countingStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	// database/sql would otherwise have asked the connection
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("dbtesting: driver does not support the use of named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
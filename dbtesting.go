@@ -3,159 +3,1673 @@ package dbtesting
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// The timeouts applied where Config leaves them zero, which the packages adapting dbtesting to other libraries share.
 const (
-	dsnEnvVar             = "DBTESTING_DSN"
-	defaultSetUpTimeout   = 10 * time.Second
-	defaultCleanUpTimeout = 3 * time.Second
-	defaultLogPrefix      = "dbtesting"
+	DefaultSetUpTimeout   = 10 * time.Second
+	DefaultCleanUpTimeout = 3 * time.Second
+	DefaultTestTimeout    = 30 * time.Second
 )
 
+const (
+	dsnEnvVar            = "DBTESTING_DSN"
+	commitEnvVar         = "DBTESTING_COMMIT"
+	strategyEnvVar       = "DBTESTING_STRATEGY"
+	isolationEnvVar      = "DBTESTING_ISOLATION"
+	connectionEnvVar     = "DBTESTING_CONNECTION"
+	defaultRetryInterval = time.Second
+	eventuallyInterval   = 50 * time.Millisecond
+	beginRetryInterval   = 50 * time.Millisecond
+	defaultLogPrefix     = "dbtesting: "
+	timingSetUp          = "SetUpFunc"
+	timingCleanUp        = "CleanUpFunc"
+	replicaName          = "replica"
+)
+
+// T is handed to tests run with Inject. What a test does through Tx is only visible within that transaction, including
+// to subtests run with RunTx: the database itself, other connections and transactions from NewTx see only what's been
+// committed, as does Eventually. Helpers which should see the test's own changes must run on its transaction, e.g.
+// with Visible.
 type T struct {
 	*testing.T
-	Tx *sql.Tx
+	Tx  *sql.Tx
+	Ctx context.Context
+	// Conn is the connection dedicated to this test, only set when Config.PerTestConn or Config.AfterConnect is.
+	Conn *sql.Conn
+
+	state      *settings
+	db         *sql.DB
+	opts       *sql.TxOptions
+	attempt    *attempt
+	rec        *Tx
+	mu         sync.Mutex
+	named      map[string]*sql.Tx
+	extra      []*sql.Tx
+	txCleanups []func() error
+	// undos are those of Autonomous, run by end in reverse
+	undos []func(context.Context, *sql.Conn) error
+	// advisory holds the keys AdvisoryLock has locked without the database
+	advisory map[int64]bool
+	began    time.Time
+	// savepoint is set when the test runs within Config.SuiteTransaction
+	savepoint string
+	// parent is set for subtests run with RunTx, which share its transactions
+	parent *T
+	// baseline is the savepoint Reset rolls back to
+	baseline string
+	// queriesBefore is the count of Config.CountQueries before the test body began
+	queriesBefore int64
+	// failed is set by Error, Errorf and Fail while the attempt may yet be abandoned
+	failed bool
+}
+
+// DatabaseConfig configures an additional named database, connected to and set up after the primary one.
+type DatabaseConfig struct {
+	ConnectFunc func() (*sql.DB, error)
+	DB          *sql.DB
+	SetUpFunc   func(context.Context, *sql.DB) error
+	CleanUpFunc func(context.Context, *sql.DB) error
+	// TxOptions defaults to the options of the test's primary transaction.
+	TxOptions *sql.TxOptions
 }
 
 type Config struct {
-	ConnectFunc    func() (*sql.DB, error)
-	SkipFunc       func() bool
+	// DSN is connected to by the default ConnectFunc, unless overridden by the -dbtesting.dsn flag or the DSNEnvVar
+	// environment variable, in that order.
+	DSN string
+	// DSNEnvVar names the environment variable holding the DSN, by default DBTESTING_DSN.
+	DSNEnvVar string
+	// Connections names DSNs, e.g. for local, CI and staging databases, one of which DBTESTING_CONNECTION selects to be
+	// used in place of DSN, so that whole DSNs needn't be kept in the environment.
+	Connections map[string]string
+
+	ConnectFunc func() (*sql.DB, error)
+	// ConnectFuncCtx is called instead of ConnectFunc when set, with a context bounded by SetUpTimeout.
+	ConnectFuncCtx func(context.Context) (*sql.DB, error)
+	// Connector is opened instead of calling ConnectFunc when set.
+	Connector driver.Connector
+	// DB is used instead of Connector or ConnectFunc when set, and is left open for the caller to close.
+	DB *sql.DB
+	// Driver names the database the tests run against, one of "postgres", "mysql" or "sqlite", and is detected from
+	// the connected database's driver when empty. It decides the SQL this package generates, e.g. for placeholders.
+	Driver string
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime are applied to the pool before it's first used; zero values leave
+	// the defaults in place.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// SkipFlagParse stops Run from calling flag.Parse, for a test bootstrap that parses flags itself; they must then be
+	// parsed before Run is called, since the default SkipFunc calls testing.Short and this package's flags are read.
+	SkipFlagParse bool
+
+	SkipFunc func() bool
+	// SkipReasonFunc takes precedence over SkipFunc, and its reason is reported by each skipped test.
+	SkipReasonFunc func() (bool, string)
+
+	// SetUpFunc prepares the database before any tests run. CleanUpFunc undoes it after they've all run, and also when
+	// SetUpFunc or anything after it fails, so it should tolerate a partial set up, e.g. with DROP TABLE IF EXISTS.
 	SetUpFunc      func(context.Context, *sql.DB) error
 	CleanUpFunc    func(context.Context, *sql.DB) error
 	SetUpTimeout   time.Duration
 	CleanUpTimeout time.Duration
-	Logger         interface {
+	TestTimeout    time.Duration
+	// TxOptions apply to injected tests' transactions. DBTESTING_ISOLATION, e.g. serializable or read_committed,
+	// overrides their isolation level, so that CI can run the same suite at each level.
+	TxOptions *sql.TxOptions
+	// SuiteTransaction begins a single transaction once set up is done, rolled back after all tests have run, and runs
+	// each injected test within a savepoint of it rather than its own transaction. Parallel tests then take turns, so
+	// they must call t.Parallel() before Inject rather than inside it, where T.Parallel fails the test, and TxOptions
+	// only apply to the suite's transaction.
+	SuiteTransaction bool
+
+	// GuardSchema fails injected tests which leave tables or indexes behind, by comparing the schema before and after
+	// each of them. It's mostly useful with InjectDB and InjectNoTx, whose changes aren't rolled back, and is ignored
+	// with SuiteTransaction. Since the whole schema is compared, tests which run in parallel with other injected tests
+	// aren't checked, and tests of other packages sharing the database shouldn't run at the same time.
+	GuardSchema bool
+
+	// TearDownFunc runs after everything else, once the database has been closed, whether or not connecting to it
+	// succeeded, e.g. to stop a container started by ConnectFunc.
+	TearDownFunc func()
+
+	// KeepSetUpFailures skips CleanUpFunc when SetUpFunc fails, leaving what it did in place for inspection.
+	KeepSetUpFailures bool
+
+	// FailOnCleanUpError makes RunTests and Run return a non-zero code when CleanUpFunc fails, even if every test
+	// passed, rather than just logging the error.
+	FailOnCleanUpError bool
+
+	// CountQueries wraps the database's driver to count every statement executed on any of its connections, for
+	// T.TotalQueries. The database must then be opened by this package, from Connector or the default DSN, as must the
+	// fresh databases of InjectFreshDB and StrategyFreshDatabase, by the default ConnectDatabaseFunc.
+	CountQueries bool
+
+	// TxContextKey, when set, is the key under which each injected test's *sql.Tx is stored in T.Ctx, for code under
+	// test which takes its transaction from the context it's given.
+	TxContextKey interface{}
+
+	// QueryTimeout bounds each query run by this package's helpers, like AssertCount, within a test. Queries run
+	// directly on T.Tx can opt in with T.QueryCtx.
+	QueryTimeout time.Duration
+
+	// ConnectRetries is the number of times connecting and pinging will be retried, within SetUpTimeout
+	ConnectRetries       int
+	ConnectRetryInterval time.Duration
+	// BeginRetries is the number of times beginning a test's transaction will be retried, with a growing delay, e.g. when
+	// many parallel tests starting at once exhaust the server's connections.
+	BeginRetries int
+	// SkipOnConnectError skips tests rather than failing the run when connecting fails, e.g. when there's no local
+	// database. The error is logged and given as the reason tests are skipped.
+	SkipOnConnectError bool
+
+	// PerTestConn dedicates a connection from the pool to each injected test for its whole duration. The connection is
+	// taken before the test body runs, so parallel tests should call t.Parallel() before Inject, e.g.
+	// func(t *testing.T) { t.Parallel(); dbtesting.Inject(f)(t) }, rather than inside f, where the paused test would
+	// hold its connection and transaction while it waits.
+	PerTestConn bool
+	// IsolateSchema runs the tests in a new Postgres schema with a random name, dropped along with everything in it
+	// afterwards, so that packages tested concurrently against the same database don't collide. Connections opened from
+	// the DSN have their search_path set to it; otherwise only connections used by injected tests are, through
+	// AfterConnect, and SetUpFunc and CleanUpFunc have to qualify names with the schema given by IsolatedSchema.
+	IsolateSchema  bool
+	isolatedSchema string
+
+	// AfterConnect applies session settings like search_path or timezone to each connection the first time a test is
+	// run on it with Inject or InjectNoTx, or else each time when the connections are opened by ConnectFunc,
+	// ConnectFuncCtx or DB, which can't be told apart. Injected tests are then dedicated a connection as with
+	// PerTestConn.
+	AfterConnect func(context.Context, *sql.Conn) error
+
+	// CommitOnSuccess commits the transactions of passing tests rather than rolling them back, so that their state can be
+	// inspected while debugging. It can also be enabled with -dbtesting.commit or by setting DBTESTING_COMMIT=1.
+	CommitOnSuccess bool
+
+	// Strategy is how tests run with Inject or BeginTest are isolated from each other, defaulting to
+	// StrategyTransaction. It's overridden by DBTESTING_STRATEGY when set, e.g. DBTESTING_STRATEGY=truncate.
+	Strategy Strategy
+
+	// DumpTablesOnFailure are logged as seen by the transaction of each injected test which fails, before it's rolled
+	// back.
+	DumpTablesOnFailure []string
+
+	// ResetTables are truncated after each test run with InjectDB; when empty, all tables in the current schema are.
+	// Foreign keys between them are handled with CASCADE on Postgres and by disabling checks on MySQL and SQLite.
+	ResetTables []string
+	// ResetFunc replaces truncating ResetTables after each test run with InjectDB.
+	ResetFunc func(context.Context, *sql.DB) error
+
+	// TemplateSetUpFunc builds a template database, created on the same server, which InjectFreshDB clones for each test.
+	TemplateSetUpFunc func(context.Context, *sql.DB) error
+	// ConnectDatabaseFunc connects to the named database on the same server, defaulting to the DSN of the default
+	// connect with the database name replaced.
+	ConnectDatabaseFunc func(name string) (*sql.DB, error)
+
+	// AfterEachTest runs within each injected test's transaction after the test and its TxCleanup functions, failing
+	// the test if it returns an error, e.g. to check conventions every test should follow.
+	AfterEachTest func(*T) error
+
+	// TxRetries is the number of times a test will be re-run in a fresh transaction after its transaction returns an
+	// error for which IsRetriable is true, e.g. a Postgres serialization failure. The error, which must be returned by
+	// a method of T.Recorded() called from the test's goroutine, abandons the attempt before the test sees it.
+	TxRetries   int
+	IsRetriable func(error) bool
+
+	// Databases are additional databases, available within tests through T.DB.
+	Databases map[string]DatabaseConfig
+	// ReplicaDSN, as "DRIVER:DSN_INFORMATION" or a URL, adds a read replica of the primary database to Databases,
+	// available within tests through T.ReplicaTx in a read-only transaction.
+	ReplicaDSN string
+
+	// ClassifyError describes errors returned by set up and clean up functions, e.g. with the SQLSTATE and constraint
+	// name of a *pq.Error, for the logged failure. An empty description adds nothing.
+	ClassifyError func(error) string
+
+	// Verbose logs each statement executed by SQL, SQLStatements, SQLFile and SQLFS before executing it, e.g. to find
+	// which part of a set up hangs. It can also be enabled with -dbtesting.verbose.
+	Verbose bool
+
+	// OnTiming is called with the duration of SetUpFunc and CleanUpFunc, and with the name of each injected test and the
+	// time from beginning its transaction to rolling it back. By default, set up and clean up times are logged.
+	OnTiming func(event string, d time.Duration)
+
+	// Logger receives everything logged outside of a test; messages concerning a single test, like rollback failures,
+	// go to that test's log instead. Slog adapts a *slog.Logger, recording events with structured fields.
+	Logger interface {
 		Printf(format string, v ...interface{})
 	}
+	// LogPrefix begins each line of the default Logger, which writes to stderr; it defaults to "dbtesting: ".
+	LogPrefix string
+}
+
+var savepointSeq uint64
+
+// suiteTxMu is held by the test running within Config.SuiteTransaction.
+var suiteTxMu sync.Mutex
+
+// settings are what tests are run with, set up by RunTests or Run for the package as a whole, or by New for a Harness.
+type settings struct {
+	Skip       bool
+	SkipReason string
+	DB         *sql.DB
+	Named      map[string]*sql.DB
+	Template   string
+	SuiteTx    *sql.Tx
+	// Initialized is set once the database is connected, so that tests can tell that RunTests wasn't called
+	Initialized bool
+	// Version is the server version of DB, as read once it's connected, or else why it couldn't be
+	Version      string
+	VersionParts []int
+	VersionErr   error
+	// Run describes the run of RunTestsEach the tests belong to, if any
+	Run string
+	Config
+}
+
+var state settings
+
+var errNotRun = errors.New("dbtesting: RunTests was not called in TestMain")
+
+// check skips t when database tests are being skipped, and fails it when they haven't been set up, rather than letting
+// it panic on a nil database.
+func (s *settings) check(t *testing.T) {
+	t.Helper()
+	if s.Skip {
+		t.Skip(s.SkipReason)
+	}
+	if !s.Initialized {
+		t.Fatal(errNotRun)
+	}
+	if s.Run != "" {
+		// the test's name is the same in every run
+		t.Logf("%v, against %v", s.Run, s.Driver)
+	}
+}
+
+// SkipUnlessDB skips t, with the reason injected tests would be skipped for, unless database tests are running, e.g.
+// for a test which only uses the database in some of its subtests.
+func SkipUnlessDB(t *testing.T) {
+	t.Helper()
+	if state.Skip {
+		t.Skip(state.SkipReason)
+	}
+}
+
+// IsolatedSchema returns the name of the schema created for Config.IsolateSchema, or "" without it, for SetUpFunc
+// and CleanUpFunc to use when the search_path of their connections isn't set to it.
+func IsolatedSchema() string {
+	return state.isolatedSchema
+}
+
+// mustRun explains why a test that must run against the database can't.
+func (s *settings) mustRun() error {
+	if s.Skip {
+		return fmt.Errorf("database tests are skipped, but this test must run: %v", s.SkipReason)
+	}
+	return nil
 }
 
-var state = struct {
-	Skip bool
-	DB   *sql.DB
-}{}
+// Skipped reports whether this run skips database tests, e.g. in short mode, so that helpers can avoid expensive work
+// for tests which won't run. It's only meaningful once RunTests or Run has been called.
+func Skipped() bool {
+	return state.Skip
+}
 
 func RunTests(m *testing.M, cfg Config) int {
+	if cfg.Logger == nil {
+		cfg.Logger = DefaultLogger(cfg.LogPrefix)
+	}
+	code, err := Run(m, cfg)
+	if err != nil {
+		logEvent(cfg.Logger, "database tests failed", []interface{}{"error", err}, "%v", err)
+	}
+	return code
+}
+
+// RunTestsEach runs the package's tests with each of cfgs in turn, set up and cleaned up separately, e.g. to run the
+// same tests against every database a storage layer supports; T.Driver tells them which they're running against. Each
+// configuration should read its DSN from a different DSNEnvVar, since -dbtesting.dsn and DBTESTING_DSN would apply to
+// all of them. Injected tests log which run they belong to, since their names are the same in each. The exit code is
+// that of the first run to fail. Profiles and coverage written by flags like -cpuprofile and -coverprofile only cover
+// the last run, since each run of m.Run rewrites them.
+func RunTestsEach(m *testing.M, cfgs ...Config) int {
+	parseFlags(cfgs...)
+	return runEach(m, cfgs)
+}
+
+func runEach(m interface{ Run() int }, cfgs []Config) int {
+	code := 0
+	for i, cfg := range cfgs {
+		if cfg.Logger == nil {
+			cfg.Logger = DefaultLogger(cfg.LogPrefix)
+		}
+		state = settings{Run: fmt.Sprintf("run %d of %d", i+1, len(cfgs))}
+		c := 1
+		cfg, err := withDefaults(cfg)
+		if err == nil {
+			c, err = state.runTests(m, cfg)
+		}
+		if err != nil {
+			logEvent(cfg.Logger, "database tests failed", []interface{}{"driver", state.Driver, "error", err}, "%v", err)
+		}
+		cfg.Logger.Printf("run %d of %d, against %v, exited with %d", i+1, len(cfgs), state.Driver, c)
+		if code == 0 {
+			code = c
+		}
+	}
+	return code
+}
+
+// Run parses the command line with flag.Parse, unless it's already been parsed, before doing anything else, so flags
+// defined by the tests themselves must be registered beforehand, e.g. at package level, and can then be read from
+// SkipFunc, SetUpFunc and the other hooks. Nothing else in this package parses flags, and Config.SkipFlagParse stops
+// Run doing so.
+func Run(m *testing.M, cfg Config) (int, error) {
+	parseFlags(cfg)
+
+	cfg, err := withDefaults(cfg)
+	if err != nil {
+		return 1, err
+	}
+
+	return state.runTests(m, cfg)
+}
+
+// Validate connects as RunTests would and runs cfg's set up, then its clean up, without running any tests, e.g. as a
+// quick check that the schema applies. Under Postgres and SQLite, SetUpFunc and CleanUpFunc run within a transaction
+// which is then rolled back, leaving the database as it was; under other drivers, whose DDL commits, SetUpFunc is given
+// the database itself, so it's CleanUpFunc which must undo it. SkipFunc and SkipOnConnectError are ignored, since
+// there's nothing to skip, flags aren't parsed, and neither the package's state nor tests running alongside are
+// disturbed.
+func Validate(cfg Config) error {
+	cfg.SkipReasonFunc = func() (bool, string) { return false, "" }
+	cfg.SkipOnConnectError = false
+	cfg, err := withDefaults(cfg)
+	if err != nil {
+		return err
+	}
+
+	var (
+		s              settings
+		cleanedUp      bool
+		cleanUpErr     error
+		setUp, cleanUp = cfg.SetUpFunc, cfg.CleanUpFunc
+	)
+	cfg.SetUpFunc = func(ctx context.Context, db *sql.DB) error {
+		if s.Driver != dialectPostgres && s.Driver != dialectSQLite {
+			return setUp(ctx, db)
+		}
+		cleanedUp = true
+		return rolledBack(ctx, db, func(db *sql.DB) error {
+			if err := setUp(ctx, db); err != nil {
+				return err
+			}
+			cleanUpErr = cleanUp(ctx, db)
+			return nil
+		})
+	}
+	cfg.CleanUpFunc = func(ctx context.Context, db *sql.DB) error {
+		if !cleanedUp {
+			cleanUpErr = cleanUp(ctx, db)
+		}
+		return cleanUpErr
+	}
+
+	if _, err := s.runTests(noTests{}, cfg); err != nil {
+		return err
+	}
+	if cleanUpErr != nil {
+		return fmt.Errorf("CleanUpFunc: %w", cleanUpErr)
+	}
+	return nil
+}
+
+// noTests stands in for testing.M when there aren't any tests to run.
+type noTests struct{}
+
+func (noTests) Run() int {
+	return 0
+}
+
+// parseIsolation parses an isolation level by the name sql.IsolationLevel gives it, ignoring case and accepting
+// underscores or hyphens for spaces, e.g. read_committed.
+func parseIsolation(s string) (sql.IsolationLevel, error) {
+	name := strings.ToLower(strings.NewReplacer("_", " ", "-", " ").Replace(s))
+	var names []string
+	for l := sql.LevelDefault; l <= sql.LevelLinearizable; l++ {
+		n := strings.ToLower(l.String())
+		if n == name {
+			return l, nil
+		}
+		names = append(names, strings.ReplaceAll(n, " ", "_"))
+	}
+	return 0, fmt.Errorf("unknown isolation level %q; expected one of %v", s, strings.Join(names, ", "))
+}
+
+// parseFlags parses the command line unless it's already been parsed or any of cfgs says it will be.
+func parseFlags(cfgs ...Config) {
+	for _, cfg := range cfgs {
+		if cfg.SkipFlagParse {
+			return
+		}
+	}
 	if !flag.Parsed() {
-		// we might rely on flags having been parsed, and this is idempotent anyway
 		flag.Parse()
 	}
+}
 
+func withDefaults(cfg Config) (Config, error) {
 	if cfg.SetUpTimeout == 0 {
-		cfg.SetUpTimeout = defaultSetUpTimeout
+		cfg.SetUpTimeout = DefaultSetUpTimeout
 	}
 	if cfg.CleanUpTimeout == 0 {
-		cfg.CleanUpTimeout = defaultCleanUpTimeout
+		cfg.CleanUpTimeout = DefaultCleanUpTimeout
+	}
+	if cfg.TestTimeout == 0 {
+		cfg.TestTimeout = DefaultTestTimeout
+	}
+	if cfg.ConnectRetryInterval == 0 {
+		cfg.ConnectRetryInterval = defaultRetryInterval
+	}
+	if cfg.DSNEnvVar == "" {
+		cfg.DSNEnvVar = dsnEnvVar
+	}
+	if name := os.Getenv(connectionEnvVar); name != "" {
+		dsn, ok := cfg.Connections[name]
+		if !ok {
+			names := make([]string, 0, len(cfg.Connections))
+			for n := range cfg.Connections {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return cfg, fmt.Errorf("invalid %v: no connection %q in Config.Connections %v", connectionEnvVar, name, names)
+		}
+		cfg.DSN = dsn
+	}
+	if cfg.IsolateSchema {
+		var err error
+		if cfg.isolatedSchema, err = uniqueName("dbtesting_"); err != nil {
+			return cfg, err
+		}
+		if cfg.ConnectFunc != nil || cfg.ConnectFuncCtx != nil || cfg.Connector != nil || cfg.DB != nil {
+			// we can't set the search path on connections we don't open
+			schema, afterConnect := cfg.isolatedSchema, cfg.AfterConnect
+			cfg.AfterConnect = func(ctx context.Context, conn *sql.Conn) error {
+				if _, err := conn.ExecContext(ctx, "SET search_path TO "+schema); err != nil {
+					return err
+				}
+				if afterConnect != nil {
+					return afterConnect(ctx, conn)
+				}
+				return nil
+			}
+		}
 	}
-	if cfg.ConnectFunc == nil {
-		cfg.ConnectFunc = defaultConnect
+	opensConns := cfg.ConnectFunc == nil && cfg.ConnectFuncCtx == nil && cfg.DB == nil
+	if cfg.CountQueries && !opensConns {
+		return cfg, errors.New("Config.CountQueries requires Config.Connector or the default connection")
+	}
+	// the connections we open are wrapped, to record the statements of tests' transactions at least
+	if opensConns && cfg.Connector != nil {
+		cfg.Connector = wrappingConnector{cfg.Connector, cfg.CountQueries}
+	} else if opensConns {
+		cfg.ConnectFunc = defaultConnect(cfg.DSNEnvVar, cfg.DSN, cfg.isolatedSchema, cfg.CountQueries)
 	}
 	if cfg.SetUpFunc == nil {
 		cfg.SetUpFunc = defaultSetUp
 	}
-	if cfg.SkipFunc == nil {
-		cfg.SkipFunc = testing.Short
+	if cfg.CleanUpFunc == nil {
+		cfg.CleanUpFunc = defaultCleanUp
+	}
+	if cfg.CountQueries && cfg.ConnectDatabaseFunc != nil && cfg.TemplateSetUpFunc != nil {
+		// the fresh databases of InjectFreshDB and StrategyFreshDatabase would go uncounted
+		return cfg, errors.New("Config.CountQueries requires the default Config.ConnectDatabaseFunc alongside Config.TemplateSetUpFunc")
+	}
+	if cfg.ConnectDatabaseFunc == nil {
+		cfg.ConnectDatabaseFunc = defaultConnectDatabase(cfg.DSNEnvVar, cfg.DSN, cfg.CountQueries)
+	}
+	if cfg.SkipReasonFunc == nil {
+		skip, reason := cfg.SkipFunc, "skipped by Config.SkipFunc"
+		if skip == nil {
+			skip, reason = defaultSkip, "skipping database tests in short mode"
+		}
+		cfg.SkipReasonFunc = func() (bool, string) { return skip(), reason }
 	}
 	if cfg.Logger == nil {
-		cfg.Logger = log.New(os.Stderr, defaultLogPrefix, log.LstdFlags)
+		cfg.Logger = DefaultLogger(cfg.LogPrefix)
+	}
+	if cfg.OnTiming == nil {
+		logger := cfg.Logger
+		cfg.OnTiming = func(event string, d time.Duration) {
+			if event == timingSetUp || event == timingCleanUp {
+				logEvent(logger, event+" finished", []interface{}{"duration", d}, "%v took %v", event, d)
+			}
+		}
+	}
+	cfg.CommitOnSuccess = cfg.CommitOnSuccess || *commitFlag
+	cfg.Verbose = cfg.Verbose || *verboseFlag
+	if v, ok := os.LookupEnv(commitEnvVar); ok && !cfg.CommitOnSuccess {
+		var err error
+		if cfg.CommitOnSuccess, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid %v: %w", commitEnvVar, err)
+		}
+	}
+
+	if v := os.Getenv(strategyEnvVar); v != "" {
+		var err error
+		if cfg.Strategy, err = parseStrategy(v); err != nil {
+			return cfg, fmt.Errorf("invalid %v: %w", strategyEnvVar, err)
+		}
+	}
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyTransaction
+	} else if _, err := parseStrategy(string(cfg.Strategy)); err != nil {
+		return cfg, fmt.Errorf("invalid Config.Strategy: %w", err)
+	}
+	if cfg.Strategy != StrategyTransaction && cfg.SuiteTransaction {
+		return cfg, fmt.Errorf("Config.SuiteTransaction is incompatible with strategy %q", cfg.Strategy)
+	}
+	if cfg.Strategy == StrategyFreshDatabase && cfg.TemplateSetUpFunc == nil {
+		return cfg, fmt.Errorf("strategy %q requires Config.TemplateSetUpFunc", cfg.Strategy)
+	}
+
+	if v := os.Getenv(isolationEnvVar); v != "" {
+		level, err := parseIsolation(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %v: %w", isolationEnvVar, err)
+		}
+		opts := sql.TxOptions{Isolation: level}
+		if cfg.TxOptions != nil {
+			opts.ReadOnly = cfg.TxOptions.ReadOnly
+		}
+		cfg.TxOptions = &opts
 	}
 
-	return runTests(m, cfg)
+	if cfg.ReplicaDSN != "" {
+		if _, ok := cfg.Databases[replicaName]; ok {
+			return cfg, fmt.Errorf("Config.ReplicaDSN conflicts with the database named %q in Config.Databases", replicaName)
+		}
+		dbs := map[string]DatabaseConfig{replicaName: {
+			ConnectFunc: connectDSN(cfg.ReplicaDSN),
+			TxOptions:   &sql.TxOptions{ReadOnly: true},
+		}}
+		for name, dc := range cfg.Databases {
+			dbs[name] = dc
+		}
+		cfg.Databases = dbs
+	}
+
+	return cfg, nil
 }
 
 func Inject(f func(*T)) func(t *testing.T) {
+	return InjectCtx(context.Background(), f)
+}
+
+// InjectCtx is like Inject, but derives the test's context, bounded by Config.TestTimeout, from ctx, e.g. so that the
+// code under test can read values from it.
+func InjectCtx(ctx context.Context, f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		inject(ctx, &state, t, TestConfig{TxOptions: state.TxOptions}, f)
+	}
+}
+
+// InjectAlways is like Inject, but fails the test rather than skipping it when database tests are skipped, e.g. in
+// short mode or by Config.SkipOnConnectError, for tests which mustn't silently go unrun.
+func InjectAlways(f func(*T)) func(t *testing.T) {
 	return func(t *testing.T) {
-		if state.Skip {
-			t.Skip()
+		if err := state.mustRun(); err != nil {
+			t.Fatalf("InjectAlways: %v", err)
 		}
+		inject(context.Background(), &state, t, TestConfig{TxOptions: state.TxOptions}, f)
+	}
+}
 
-		tx, err := state.DB.BeginTx(context.Background(), nil)
-		if err != nil {
-			t.Fatalf("db.BeginTX: %v", err)
+func InjectWithOptions(opts *sql.TxOptions, f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		inject(context.Background(), &state, t, TestConfig{TxOptions: opts}, f)
+	}
+}
+
+// TestConfig configures a single test run with InjectWith.
+type TestConfig struct {
+	// TxOptions defaults to Config.TxOptions.
+	TxOptions *sql.TxOptions
+	// SetUp runs within the test's transaction before the test, so anything it inserts is rolled back too.
+	SetUp func(*T) error
+	// CleanUp runs within the test's transaction after the test, whether or not it failed.
+	CleanUp func(*T) error
+	// Resettable takes a savepoint once SetUp has run, for T.Reset to roll back to.
+	Resettable bool
+	// BeginTx replaces beginning the test's transaction on the database, e.g. to begin it through another library. It's
+	// ignored when Config.PerTestConn or Config.AfterConnect is set, and under Config.SuiteTransaction.
+	BeginTx func(context.Context, *sql.DB, *sql.TxOptions) (*sql.Tx, error)
+}
+
+func InjectWith(tc TestConfig, f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		if tc.TxOptions == nil {
+			tc.TxOptions = state.TxOptions
 		}
+		inject(context.Background(), &state, t, tc, f)
+	}
+}
+
+func inject(parent context.Context, s *settings, t *testing.T, tc TestConfig, f func(*T)) {
+	s.check(t)
+
+	defer s.guardSchema(t)()
+
+	ctx, cncl := context.WithTimeout(parent, s.TestTimeout)
+	// the context is only cancelled after rollback, otherwise database/sql would roll back for us
+	defer cncl()
+
+	db, done, err := s.strategyDB(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	conn, err := s.dedicatedConn(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != nil {
+		defer closeConn(t, conn)
+	}
+
+	injectAttempts(t, ctx, s, db, conn, tc, f)
+}
+
+// InjectOn is like Inject, but begins the test's only transaction, t.Tx, on the database configured under name in
+// Config.Databases, for tests which don't need the primary database; t.DB(name) returns t.Tx, and the other databases
+// are still available through T.DB. Config.Strategy, SuiteTransaction, GuardSchema and DumpTablesOnFailure concern the
+// primary database, so they're ignored.
+func InjectOn(name string, f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		injectOn(&state, t, name, f)
+	}
+}
+
+func injectOn(s *settings, t *testing.T, name string, f func(*T)) {
+	s.check(t)
+
+	db, ok := s.Named[name]
+	if !ok {
+		t.Fatalf("InjectOn: no database named %q in Config.Databases", name)
+	}
+	on := *s
+	on.SuiteTx, on.Strategy, on.DumpTablesOnFailure = nil, StrategyTransaction, nil
+	on.Driver = detectDialect(db.Driver())
+	on.Version, on.VersionParts, on.VersionErr = "", nil, errors.New("server versions are only read from the primary database")
+	tc := TestConfig{TxOptions: s.TxOptions}
+	if o := s.Databases[name].TxOptions; o != nil {
+		tc.TxOptions = o
+	}
+
+	ctx, cncl := context.WithTimeout(context.Background(), s.TestTimeout)
+	defer cncl()
+	injectAttempts(t, ctx, &on, db, nil, tc, f)
+}
+
+// injectAttempts runs f until an attempt isn't aborted by a retriable error, or Config.TxRetries have been made.
+func injectAttempts(t *testing.T, ctx context.Context, s *settings, db *sql.DB, conn *sql.Conn, tc TestConfig, f func(*T)) {
+	for i := 1; ; i++ {
+		a := &attempt{retriable: s.IsRetriable != nil && i <= s.TxRetries, isRetriable: s.IsRetriable}
+		if injectAttempt(t, ctx, s, db, conn, tc, a, f); a.err == nil {
+			return
+		}
+		t.Logf("attempt %d of %d aborted by a retriable error: %v", i, s.TxRetries+1, a.err)
+	}
+}
+
+// BeginTest begins a transaction for t like Inject, but returns errors rather than failing t, for building other
+// harnesses on. The returned function should be deferred: it runs t's TxCleanup functions and then rolls back or, as
+// configured, commits. Retriable errors aren't retried.
+func BeginTest(t *testing.T) (*T, func(), error) {
+	if state.Skip {
+		t.Skip(state.SkipReason)
+	}
+	if !state.Initialized {
+		return nil, nil, errNotRun
+	}
+
+	ctx, cncl := context.WithTimeout(context.Background(), state.TestTimeout)
+	db, done, err := state.strategyDB(ctx, t)
+	if err != nil {
+		cncl()
+		return nil, nil, err
+	}
+	conn, err := state.dedicatedConn(ctx, db)
+	if err != nil {
+		done()
+		cncl()
+		return nil, nil, err
+	}
+	release := func() {
+		if conn != nil {
+			closeConn(t, conn)
+		}
+		done()
+		cncl()
+	}
+
+	tt, err := begin(t, ctx, &state, db, conn, TestConfig{TxOptions: state.TxOptions}, &attempt{})
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return tt, func() {
+		p := recover()
 		defer func() {
-			if p := recover(); p != nil {
-				if err := tx.Rollback(); err != nil {
-					t.Logf("tx.Rollback during panic: %v", err)
-				}
+			tt.end(p != nil)
+			release()
+			if p != nil {
 				panic(p)
 			}
-			if err := tx.Rollback(); err != nil {
-				t.Logf("tx.Rollback on test complete: %v", err)
-			}
 		}()
-		f(&T{t, tx})
+		if p == nil {
+			defer tt.dumpOnFailure()
+			tt.runTxCleanups()
+			tt.afterEachTest()
+		}
+	}, nil
+}
+
+// dedicatedConn takes a connection for a single test when the configuration calls for one.
+func (s *settings) dedicatedConn(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	if !s.PerTestConn && s.AfterConnect == nil || s.SuiteTx != nil {
+		return nil, nil
 	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.Conn: %w", err)
+	}
+	if err := s.prepareConn(ctx, conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("Config.AfterConnect: %w", err)
+	}
+	return conn, nil
 }
 
-func SQL(query string) func(context.Context, *sql.DB) error {
-	return func(ctx context.Context, db *sql.DB) error {
-		_, err := db.ExecContext(ctx, query)
+func closeConn(t *testing.T, conn *sql.Conn) {
+	if err := conn.Close(); err != nil {
+		t.Logf("conn.Close: %v", err)
+	}
+}
+
+// prepareConn applies Config.AfterConnect to conn unless it already has been, which is only known of the connections
+// this package opens.
+func (s *settings) prepareConn(ctx context.Context, conn *sql.Conn) error {
+	if s.AfterConnect == nil {
+		return nil
+	}
+
+	var prepared bool
+	if err := conn.Raw(func(dc interface{}) error {
+		w, ok := dc.(*wrappedConn)
+		prepared = ok && w.prepared
+		return nil
+	}); err != nil || prepared {
+		return err
+	}
+
+	if err := s.AfterConnect(ctx, conn); err != nil {
 		return err
 	}
+	return conn.Raw(func(dc interface{}) error {
+		if w, ok := dc.(*wrappedConn); ok {
+			w.prepared = true
+		}
+		return nil
+	})
+}
+
+// Error is like testing.T.Error, but see Errorf.
+func (t *T) Error(args ...interface{}) {
+	t.Helper()
+	t.Log(args...)
+	t.Fail()
+}
+
+// Errorf is like testing.T.Errorf, except that while the test may yet be re-run under Config.TxRetries, the failure
+// is only reported once the attempt ends without being abandoned, so that a retry which succeeds passes.
+func (t *T) Errorf(format string, args ...interface{}) {
+	t.Helper()
+	t.Logf(format, args...)
+	t.Fail()
+}
+
+// Fail is like testing.T.Fail, but see Errorf.
+func (t *T) Fail() {
+	if t.attempt == nil || !t.attempt.retriable {
+		t.T.Fail()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed = true
+}
+
+// Failed is like testing.T.Failed, but includes failures Errorf has yet to report.
+func (t *T) Failed() bool {
+	return t.T.Failed() || t.failedAttempt()
+}
+
+// Parallel is like testing.T.Parallel, but fails a test within Config.SuiteTransaction, which would otherwise pause
+// while holding the suite's transaction, so that every other test waits on it until the run times out.
+func (t *T) Parallel() {
+	t.Helper()
+	if reason := t.parallelUnsupported(); reason != "" {
+		t.Fatal(reason)
+	}
+	t.T.Parallel()
 }
 
-func runTests(m interface{ Run() int }, cfg Config) int {
-	if state.Skip = cfg.SkipFunc(); state.Skip {
-		return m.Run()
+func (t *T) parallelUnsupported() string {
+	if t.root().savepoint == "" {
+		return ""
 	}
+	return "Parallel: tests within Config.SuiteTransaction must call t.Parallel() before Inject, not inside it"
+}
+
+func (t *T) failedAttempt() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed
+}
+
+// attempt is shared by the transactions of a single run of a test body, which is abandoned by panicking with the
+// attempt itself when one of them sees a retriable error.
+type attempt struct {
+	retriable   bool
+	isRetriable func(error) bool
+	err         error
+}
 
-	db, err := cfg.ConnectFunc()
+func injectAttempt(t *testing.T, ctx context.Context, s *settings, db *sql.DB, conn *sql.Conn, tc TestConfig, a *attempt, f func(*T)) {
+	tt, err := begin(t, ctx, s, db, conn, tc, a)
 	if err != nil {
-		log.Printf("unable to connect: %v", err)
-		return 1
+		t.Fatal(err)
 	}
 	defer func() {
-		if err := db.Close(); err != nil {
-			log.Printf("db.Close: %v", err)
+		p := recover()
+		if p == a {
+			p = nil
+		}
+		tt.end(p != nil || a.err != nil)
+		if a.err == nil && tt.failedAttempt() {
+			t.Fail()
+		}
+		if p != nil {
+			// the stack still holds the panicking frames here
+			t.Logf("transaction rolled back after panic: %v\n%s", p, debug.Stack())
+			panic(p)
+		}
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			panic(p)
+		}
+		if a.err == nil {
+			tt.dumpOnFailure()
 		}
 	}()
 
-	ctx, cncl := context.WithTimeout(context.Background(), cfg.SetUpTimeout)
+	if tc.SetUp != nil {
+		if err := tc.SetUp(tt); err != nil {
+			t.Fatalf("TestConfig.SetUp: %v", err)
+		}
+	}
+	if tc.Resettable {
+		tt.baseline = fmt.Sprintf("dbtesting_reset_%d", atomic.AddUint64(&savepointSeq, 1))
+		if _, err := tt.Tx.ExecContext(unrecorded(tt.Ctx), "SAVEPOINT "+tt.baseline); err != nil {
+			t.Fatalf("TestConfig.Resettable: SAVEPOINT %v: %v", tt.baseline, err)
+		}
+	}
+	if tc.CleanUp != nil {
+		defer func() {
+			if p := recover(); p != nil {
+				// a CleanUp calling t.Fatal here would swallow the panic
+				panic(p)
+			}
+			if a.err != nil {
+				// the attempt is being abandoned
+				return
+			}
+			if err := tc.CleanUp(tt); err != nil {
+				t.Errorf("TestConfig.CleanUp: %v", err)
+			}
+		}()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			panic(p)
+		}
+		if a.err == nil {
+			tt.runTxCleanups()
+			tt.afterEachTest()
+		}
+	}()
+	tt.queriesBefore = atomic.LoadInt64(&totalQueries)
+	f(tt)
+}
+
+func begin(t *testing.T, ctx context.Context, s *settings, db *sql.DB, conn *sql.Conn, tc TestConfig, a *attempt) (*T, error) {
+	var (
+		tx    *sql.Tx
+		err   error
+		began = time.Now()
+	)
+	if s.SuiteTx != nil {
+		// released by end, since tests sharing the transaction would otherwise see and roll back each other's changes
+		suiteTxMu.Lock()
+		name := fmt.Sprintf("dbtesting_test_%d", atomic.AddUint64(&savepointSeq, 1))
+		if _, err := s.SuiteTx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+			suiteTxMu.Unlock()
+			return nil, fmt.Errorf("SAVEPOINT %v: %w", name, err)
+		}
+		tt := &T{T: t, Tx: s.SuiteTx, rec: &Tx{Tx: s.SuiteTx, attempt: a}, Ctx: withTx(ctx, s, s.SuiteTx), Conn: conn, state: s, opts: tc.TxOptions, attempt: a, db: db}
+		tt.began, tt.savepoint = began, name
+		return tt, nil
+	}
+
+	// the connection records what's run on the transaction to rec, when it's one of ours
+	rec := &Tx{attempt: a}
+	for retries := 0; ; retries++ {
+		if tx, err = beginTx(context.WithValue(ctx, recorderKey{}, rec), db, conn, tc); err == nil {
+			break
+		}
+		if retries == s.BeginRetries || ctx.Err() != nil {
+			if retries > 0 {
+				return nil, fmt.Errorf("db.BeginTx, retried %d times: %w", retries, err)
+			}
+			return nil, fmt.Errorf("db.BeginTx: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(retries+1) * beginRetryInterval):
+		}
+	}
+	rec.Tx = tx
+	return &T{T: t, Tx: tx, rec: rec, Ctx: withTx(ctx, s, tx), Conn: conn, state: s, opts: tc.TxOptions, attempt: a, began: began, db: db}, nil
+}
+
+// withTx stores tx in ctx under Config.TxContextKey, when it's set.
+func withTx(ctx context.Context, s *settings, tx *sql.Tx) context.Context {
+	if s.TxContextKey == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, s.TxContextKey, tx)
+}
+
+func beginTx(ctx context.Context, db *sql.DB, conn *sql.Conn, tc TestConfig) (*sql.Tx, error) {
+	switch {
+	case conn != nil:
+		return conn.BeginTx(ctx, tc.TxOptions)
+	case tc.BeginTx != nil:
+		return tc.BeginTx(ctx, db, tc.TxOptions)
+	}
+	return db.BeginTx(ctx, tc.TxOptions)
+}
+
+// end finishes the test's transactions, rolling them back when the test is being abandoned.
+func (t *T) end(abandon bool) {
+	// rolled back first, since they may hold locks the others are waiting on
+	for _, tx := range t.extra {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			t.Logf("NewTx: tx.Rollback on test complete: %v", err)
+		}
+	}
+	for name, tx := range t.named {
+		t.endTx(name+": ", tx, abandon)
+	}
+	if t.savepoint == "" {
+		t.endTx("", t.Tx, abandon)
+	} else {
+		// the test may have run out of time, but the suite's transaction must still be restored for the next one
+		ctx, cncl := context.WithTimeout(context.Background(), t.state.CleanUpTimeout)
+		defer cncl()
+		if _, err := t.Tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+t.savepoint); err != nil {
+			t.Errorf("rollback to savepoint %v: %v", t.savepoint, err)
+		} else if _, err := t.Tx.ExecContext(ctx, "RELEASE SAVEPOINT "+t.savepoint); err != nil {
+			t.Errorf("release savepoint %v: %v", t.savepoint, err)
+		}
+		suiteTxMu.Unlock()
+	}
+	t.runUndos()
+	if t.state.OnTiming != nil {
+		t.state.OnTiming(t.Name(), time.Since(t.began))
+	}
+}
+
+// endTx commits or rolls back tx. It's not an error for the test to have done so itself, e.g. by committing, though
+// anything it committed won't be rolled back and may be seen by other tests.
+func (t *T) endTx(prefix string, tx *sql.Tx, panicking bool) {
+	if panicking {
+		if err := tx.Rollback(); errors.Is(err, sql.ErrTxDone) {
+			t.Logf("%vtransaction was already committed or rolled back by the test", prefix)
+		} else if err != nil {
+			t.Logf("%vrollback failed while handling panic: %v", prefix, err)
+		}
+		return
+	}
+	if (t.state.CommitOnSuccess || t.state.Strategy == StrategyTruncate) && !t.Failed() {
+		if err := tx.Commit(); errors.Is(err, sql.ErrTxDone) {
+			t.Logf("%vtransaction was already committed or rolled back by the test", prefix)
+		} else if err != nil {
+			t.Errorf("%vtx.Commit on test success: %v", prefix, err)
+		}
+		return
+	}
+	if err := tx.Rollback(); errors.Is(err, sql.ErrTxDone) {
+		t.Logf("%vtransaction was already committed or rolled back by the test", prefix)
+	} else if err != nil {
+		t.Logf("%vtx.Rollback on test complete: %v", prefix, err)
+	}
+}
+
+// DB returns a transaction on the database configured under name in Config.Databases, beginning it on first use. It's
+// rolled back independently of t.Tx when the test completes.
+func (t *T) DB(name string) *sql.Tx {
+	t.Helper()
+
+	root := t.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if tx, ok := root.named[name]; ok {
+		return tx
+	}
+
+	db, ok := t.state.Named[name]
+	if !ok {
+		t.Fatalf("DB: no database named %q in Config.Databases", name)
+	}
+	if db == root.db {
+		// begun by InjectOn
+		return root.Tx
+	}
+	opts := t.opts
+	if o := t.state.Databases[name].TxOptions; o != nil {
+		opts = o
+	}
+	tx, err := db.BeginTx(t.Ctx, opts)
+	if err != nil {
+		t.Fatalf("DB: %v: db.BeginTx: %v", name, err)
+	}
+
+	if root.named == nil {
+		root.named = make(map[string]*sql.Tx)
+	}
+	root.named[name] = tx
+	return tx
+}
+
+// NewTx begins a transaction on the primary database independent of T.Tx, e.g. to check how concurrent transactions
+// lock each other out. It sees nothing uncommitted by T.Tx. The returned func rolls it back, and it is rolled back when
+// the test ends if it's still open.
+func (t *T) NewTx() (*sql.Tx, func(), error) {
+	root := t.root()
+	tx, err := root.db.BeginTx(t.Ctx, t.opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.BeginTx: %w", err)
+	}
+
+	root.mu.Lock()
+	root.extra = append(root.extra, tx)
+	root.mu.Unlock()
+
+	return tx, func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			t.Logf("NewTx: tx.Rollback: %v", err)
+		}
+	}, nil
+}
+
+// Autonomous runs do on a connection of its own, outside of the test's transaction, so that what it does is committed,
+// e.g. for another session to see. Since that escapes the rollback, undo must reverse it: it runs once the test's
+// transaction has ended, on another connection, even if do failed part way, so it should tolerate a partial do, e.g.
+// with DELETE rather than expecting rows to exist.
+func (t *T) Autonomous(do, undo func(context.Context, *sql.Conn) error) {
+	t.Helper()
+
+	if undo == nil {
+		t.Fatal("Autonomous: undo is required, since what do commits isn't rolled back")
+	}
+	root := t.root()
+	// registered first so that a failing do is still undone, and on the root so that it runs after its rollback, while
+	// the database, which may be the test's alone under StrategyFreshDatabase, is still open
+	root.mu.Lock()
+	root.undos = append(root.undos, undo)
+	root.mu.Unlock()
+	if err := autonomous(t.Ctx, root.db, do); err != nil {
+		t.Fatalf("Autonomous: %v", err)
+	}
+}
+
+// runUndos runs the undos registered by Autonomous, last first.
+func (t *T) runUndos() {
+	ctx, cncl := context.WithTimeout(context.Background(), t.state.CleanUpTimeout)
 	defer cncl()
+	for i := len(t.undos) - 1; i >= 0; i-- {
+		if err := autonomous(ctx, t.db, t.undos[i]); err != nil {
+			t.Errorf("Autonomous: undo: %v", err)
+		}
+	}
+	t.undos = nil
+}
 
-	if err := db.PingContext(ctx); err != nil {
-		log.Printf("db.PingContext: %v", err)
-		return 1
+func autonomous(ctx context.Context, db *sql.DB, f func(context.Context, *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Conn: %w", err)
+	}
+	defer conn.Close()
+	return f(ctx, conn)
+}
+
+// root returns the test whose transactions t shares, which is t itself unless it's a subtest run with RunTx.
+func (t *T) root() *T {
+	for t.parent != nil {
+		t = t.parent
+	}
+	return t
+}
+
+// Driver returns the name of the primary database's driver, as described by Config.Driver.
+func (t *T) Driver() string {
+	return t.state.Driver
+}
+
+// QueryCtx returns a context for a single query, bounded by Config.QueryTimeout when set, as used by this package's
+// helpers.
+func (t *T) QueryCtx() (context.Context, context.CancelFunc) {
+	if t.state.QueryTimeout == 0 {
+		return context.WithCancel(t.Ctx)
+	}
+	return context.WithTimeout(t.Ctx, t.state.QueryTimeout)
+}
+
+// helperCtx is like QueryCtx, for the statements of this package's helpers, which Queries excludes.
+func (t *T) helperCtx() (context.Context, context.CancelFunc) {
+	ctx, cncl := t.QueryCtx()
+	return unrecorded(ctx), cncl
+}
+
+// ReplicaTx returns the read-only transaction on the database configured by Config.ReplicaDSN, beginning it on first
+// use.
+func (t *T) ReplicaTx() *sql.Tx {
+	t.Helper()
+
+	return t.DB(replicaName)
+}
+
+// Recorded returns t.Tx wrapped to record the queries run through it, for Queries, and to abandon the attempt at
+// running the test on its retriable errors, under Config.TxRetries.
+func (t *T) Recorded() *Tx {
+	return t.rec
+}
+
+// Queries returns the queries run on the test's transaction since it began, excluding those run by this package's
+// helpers. Those run on t.Tx are only recorded by connections this package opened, from Config.Connector or the
+// default DSN, and outside of Config.SuiteTransaction; otherwise, only those run through t.Recorded() are.
+func (t *T) Queries() []string {
+	return t.rec.Queries()
+}
+
+// advisoryLocks holds a mutex for each key passed to T.AdvisoryLock where it can't lock the database.
+var advisoryLocks sync.Map
+
+// AdvisoryLock serializes tests calling it with the same key, e.g. because they update a shared row, even when they're
+// run in parallel. On Postgres it takes pg_advisory_xact_lock within the test's transaction, serializing tests across
+// packages until the transaction ends. With other drivers, or within Config.SuiteTransaction, whose transaction
+// outlives the test, it only serializes the tests of this package until the calling test or subtest finishes. Either
+// way, a test may take the same lock again, which does nothing.
+func (t *T) AdvisoryLock(key int64) {
+	t.Helper()
+
+	if t.Driver() == dialectPostgres && t.root().savepoint == "" {
+		if _, err := t.Tx.ExecContext(unrecorded(t.Ctx), "SELECT pg_advisory_xact_lock($1)", key); err != nil {
+			t.Fatalf("AdvisoryLock: %v", err)
+		}
+		return
+	}
+
+	// reentrant, like pg_advisory_xact_lock within a transaction
+	root := t.root()
+	root.mu.Lock()
+	held := root.advisory[key]
+	if !held {
+		if root.advisory == nil {
+			root.advisory = make(map[int64]bool)
+		}
+		root.advisory[key] = true
+	}
+	root.mu.Unlock()
+	if held {
+		return
 	}
 
-	if err := cfg.SetUpFunc(ctx, db); err != nil {
-		log.Printf("SetUpFunc: %v", err)
-		return 1
+	mu, _ := advisoryLocks.LoadOrStore(key, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	t.Cleanup(func() {
+		root.mu.Lock()
+		delete(root.advisory, key)
+		root.mu.Unlock()
+		mu.(*sync.Mutex).Unlock()
+	})
+}
+
+// Visible runs f on the test's transaction, in which all of its uncommitted changes are visible, for helpers shared
+// with code outside of this package which take a *sql.Tx.
+func (t *T) Visible(f func(*sql.Tx)) {
+	t.Helper()
+	f(t.Tx)
+}
+
+// TxCleanup registers f to run while the test's transaction is still open, e.g. to read its final state. Functions
+// registered this way run in last-in, first-out order once the test body returns, followed by TestConfig.CleanUp, and
+// then the transaction is rolled back; functions registered with t.Cleanup run only after that. Neither TxCleanup
+// functions nor TestConfig.CleanUp run if the test panics.
+func (t *T) TxCleanup(f func() error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.txCleanups = append(t.txCleanups, f)
+}
+
+func (t *T) runTxCleanups() {
+	t.mu.Lock()
+	cleanups := t.txCleanups
+	t.txCleanups = nil
+	t.mu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		if err := cleanups[i](); err != nil {
+			t.Errorf("TxCleanup: %v", err)
+		}
 	}
+}
 
-	state.DB = db
+func (t *T) afterEachTest() {
+	if t.state.AfterEachTest == nil {
+		return
+	}
+	if err := t.state.AfterEachTest(t); err != nil {
+		t.Errorf("Config.AfterEachTest: %v", err)
+	}
+}
 
+// Reset rolls back everything the test has done through Tx since it began, after TestConfig.SetUp, e.g. so that each
+// case of a table driven test starts from the same state; it can be called any number of times. It requires the test
+// to be injected with TestConfig.Resettable, e.g. by InjectWith(TestConfig{Resettable: true}, f), since plain Inject
+// takes no savepoint to roll back to, and fails the test otherwise. Within a subtest run with RunTx, it rolls back only
+// what the subtest has done, and is always available. Transactions on other databases aren't reset.
+func (t *T) Reset() {
+	t.Helper()
+
+	if t.baseline == "" {
+		t.Fatal("Reset: requires the test to be injected with TestConfig.Resettable, e.g. by InjectWith(TestConfig{Resettable: true}, f)")
+	}
+	// the savepoint remains after rolling back to it, ready for the next Reset
+	if _, err := t.Tx.ExecContext(unrecorded(t.Ctx), "ROLLBACK TO SAVEPOINT "+t.baseline); err != nil {
+		t.Fatalf("Reset: rollback to savepoint %v: %v", t.baseline, err)
+	}
+}
+
+// RunTx runs f as a subtest within a savepoint of t's transaction, which is rolled back when the subtest finishes, so
+// that sibling subtests sharing t's setup don't see each other's changes. Subtests run this way mustn't call
+// t.Parallel, since they share t's transaction.
+func (t *T) RunTx(name string, f func(*T)) bool {
+	ok := t.Run(name, func(st *testing.T) {
+		name := fmt.Sprintf("dbtesting_savepoint_%d", atomic.AddUint64(&savepointSeq, 1))
+		sub := &T{T: st, Tx: t.Tx, rec: t.rec, Ctx: t.Ctx, Conn: t.Conn, state: t.state, opts: t.opts, attempt: t.attempt, parent: t, baseline: name}
+		defer func() {
+			// a retriable error abandons the whole attempt, which is handled on the parent's goroutine
+			if p := recover(); p != nil && p != t.attempt {
+				panic(p)
+			} else if p != nil {
+				st.SkipNow()
+			}
+			if sub.failedAttempt() {
+				st.Fail()
+			}
+		}()
+		sub.Savepoint(name, func(sub *T) {
+			defer func() {
+				if p := recover(); p != nil {
+					panic(p)
+				}
+				sub.runTxCleanups()
+			}()
+			f(sub)
+		})
+	})
+	if t.attempt != nil && t.attempt.err != nil {
+		panic(t.attempt)
+	}
+	return ok
+}
+
+func (t *T) Savepoint(name string, f func(*T)) {
+	if name == "" {
+		name = fmt.Sprintf("dbtesting_savepoint_%d", atomic.AddUint64(&savepointSeq, 1))
+	}
+
+	if _, err := t.Tx.ExecContext(unrecorded(t.Ctx), "SAVEPOINT "+name); err != nil {
+		t.Fatalf("SAVEPOINT %v: %v", name, err)
+	}
 	defer func() {
-		ctx, cncl := context.WithTimeout(context.Background(), cfg.SetUpTimeout)
-		defer cncl()
-		if err := cfg.CleanUpFunc(ctx, db); err != nil {
-			log.Printf("CleanUpFunc: %v", err)
+		if p := recover(); p != nil {
+			if err := rollbackToSavepoint(t, name); err != nil {
+				t.Logf("rollback to savepoint %v failed while handling panic: %v", name, err)
+			}
+			panic(p)
+		}
+		if err := rollbackToSavepoint(t, name); err != nil {
+			t.Errorf("rollback to savepoint %v: %v", name, err)
 		}
 	}()
+	f(t)
+}
 
-	return m.Run()
+func rollbackToSavepoint(t *T, name string) error {
+	if _, err := t.Tx.ExecContext(unrecorded(t.Ctx), "ROLLBACK TO SAVEPOINT "+name); err != nil {
+		return err
+	}
+	_, err := t.Tx.ExecContext(unrecorded(t.Ctx), "RELEASE SAVEPOINT "+name)
+	return err
 }
 
-func defaultConnect() (*sql.DB, error) {
-	dsn, ok := os.LookupEnv(dsnEnvVar)
-	if !ok {
-		return nil, fmt.Errorf("expected environment variable: %v", dsnEnvVar)
+// runTests connects and sets up the database as cfg describes, recording it in s, then runs m and cleans up.
+func (s *settings) runTests(m interface{ Run() int }, cfg Config) (code int, err error) {
+	if s.Skip, s.SkipReason = cfg.SkipReasonFunc(); s.Skip {
+		return m.Run(), nil
+	}
+	if cfg.TearDownFunc != nil {
+		// registered first so that it runs last, even if connecting fails
+		defer cfg.TearDownFunc()
+	}
+
+	ctx, cncl := context.WithTimeout(withSettings(context.Background(), s), cfg.SetUpTimeout)
+	defer cncl()
+
+	db, err := connect(ctx, cfg)
+	if err != nil && cfg.SkipOnConnectError {
+		logEvent(cfg.Logger, "skipping database tests", []interface{}{"error", err}, "skipping database tests: %v", err)
+		s.Skip, s.SkipReason = true, fmt.Sprintf("skipping database tests: %v", err)
+		return m.Run(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	if cfg.DB == nil {
+		// we only close what we opened
+		defer func() {
+			if err := db.Close(); err != nil {
+				cfg.Logger.Printf("db.Close: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Driver == "" {
+		cfg.Driver = detectDialect(db.Driver())
+	}
+	// set before SetUpFunc runs so that helpers like Fixtures generate SQL for the configured driver, and SQL logs as
+	// configured
+	s.DB, s.Config, s.Initialized = db, cfg, true
+	s.probeVersion(ctx)
+
+	if cfg.isolatedSchema != "" {
+		if cfg.Driver != dialectPostgres {
+			return 1, fmt.Errorf("Config.IsolateSchema is unsupported for driver %q", cfg.Driver)
+		}
+		if _, err := db.ExecContext(ctx, "CREATE SCHEMA "+cfg.isolatedSchema); err != nil {
+			return 1, fmt.Errorf("creating schema %v: %w", cfg.isolatedSchema, err)
+		}
+		defer func() {
+			ctx, cncl := context.WithTimeout(withSettings(context.Background(), s), cfg.CleanUpTimeout)
+			defer cncl()
+			if _, err := db.ExecContext(ctx, "DROP SCHEMA "+cfg.isolatedSchema+" CASCADE"); err != nil {
+				cfg.Logger.Printf("dropping schema %v: %v", cfg.isolatedSchema, err)
+			}
+		}()
+	}
+
+	began := time.Now()
+	err = cfg.SetUpFunc(ctx, db)
+	if err == nil || !cfg.KeepSetUpFailures {
+		// registered now so that a partially successful set up, or a failure in what follows, is still cleaned up
+		defer func() {
+			ctx, cncl := context.WithTimeout(withSettings(context.Background(), s), cfg.CleanUpTimeout)
+			defer cncl()
+			began := time.Now()
+			if err := cfg.CleanUpFunc(ctx, db); err != nil {
+				err := stepError(ctx, cfg.ClassifyError, "CleanUpFunc", "CleanUpTimeout", cfg.CleanUpTimeout, err)
+				logEvent(cfg.Logger, "CleanUpFunc failed", []interface{}{"driver", cfg.Driver, "error", err}, "%v", err)
+				if cfg.FailOnCleanUpError && code == 0 {
+					code = 1
+				}
+			}
+			cfg.OnTiming(timingCleanUp, time.Since(began))
+		}()
+	}
+	if err != nil {
+		return 1, hintDuplicate(stepError(ctx, cfg.ClassifyError, "SetUpFunc", "SetUpTimeout", cfg.SetUpTimeout, err))
+	}
+	cfg.OnTiming(timingSetUp, time.Since(began))
+
+	named, err := connectNamed(ctx, cfg)
+	for _, f := range named.closers {
+		defer f()
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	if cfg.TemplateSetUpFunc != nil {
+		if s.Template, err = createTemplate(ctx, db, cfg); err != nil {
+			return 1, hintDuplicate(stepError(ctx, cfg.ClassifyError, "TemplateSetUpFunc", "SetUpTimeout", cfg.SetUpTimeout, err))
+		}
+		defer func() {
+			if err := dropDatabase(db, s.Template, cfg.CleanUpTimeout); err != nil {
+				cfg.Logger.Printf("%v", err)
+			}
+		}()
+	}
+
+	s.Named = named.dbs
+
+	if cfg.SuiteTransaction {
+		// not bound by the set up context, since it must outlive it
+		if s.SuiteTx, err = db.BeginTx(context.Background(), cfg.TxOptions); err != nil {
+			return 1, fmt.Errorf("beginning the suite transaction: %w", err)
+		}
+		defer func() {
+			if err := s.SuiteTx.Rollback(); err != nil {
+				cfg.Logger.Printf("rolling back the suite transaction: %v", err)
+			}
+			s.SuiteTx = nil
+		}()
+	}
+
+	return m.Run(), nil
+}
+
+type namedDBs struct {
+	dbs map[string]*sql.DB
+	// closers clean up and close each database, and should be deferred in order
+	closers []func()
+}
+
+func connectNamed(ctx context.Context, cfg Config) (namedDBs, error) {
+	names := make([]string, 0, len(cfg.Databases))
+	for name := range cfg.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	named := namedDBs{dbs: make(map[string]*sql.DB, len(names))}
+	for _, name := range names {
+		name, dc := name, cfg.Databases[name]
+		if dc.ConnectFunc == nil && dc.DB == nil {
+			return named, fmt.Errorf("%v: expected a ConnectFunc or DB", name)
+		}
+
+		c := cfg
+		c.ConnectFunc, c.ConnectFuncCtx, c.Connector, c.DB = dc.ConnectFunc, nil, nil, dc.DB
+		db, err := connect(ctx, c)
+		if err != nil {
+			return named, fmt.Errorf("%v: %w", name, err)
+		}
+		if dc.DB == nil {
+			named.closers = append(named.closers, func() {
+				if err := db.Close(); err != nil {
+					cfg.Logger.Printf("%v: db.Close: %v", name, err)
+				}
+			})
+		}
+
+		if dc.SetUpFunc != nil {
+			if err := dc.SetUpFunc(ctx, db); err != nil {
+				return named, fmt.Errorf("%v: %w", name, hintDuplicate(stepError(ctx, cfg.ClassifyError, "SetUpFunc", "SetUpTimeout", cfg.SetUpTimeout, err)))
+			}
+		}
+		if dc.CleanUpFunc != nil {
+			named.closers = append(named.closers, func() {
+				ctx, cncl := context.WithTimeout(withSettings(context.Background(), settingsOf(ctx)), cfg.CleanUpTimeout)
+				defer cncl()
+				if err := dc.CleanUpFunc(ctx, db); err != nil {
+					cfg.Logger.Printf("%v: %v", name, stepError(ctx, cfg.ClassifyError, "CleanUpFunc", "CleanUpTimeout", cfg.CleanUpTimeout, err))
+				}
+			})
+		}
+
+		named.dbs[name] = db
+	}
+	return named, nil
+}
+
+// stepError names the step which failed, and the timeout it exceeded if that's why; drivers don't always return
+// context.DeadlineExceeded themselves, e.g. pq reports a cancelled statement.
+func stepError(ctx context.Context, classify func(error) string, step, timeoutName string, timeout time.Duration, err error) error {
+	if classify != nil {
+		if class := classify(err); class != "" {
+			err = fmt.Errorf("%w (%v)", err, class)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%v exceeded %v (%v): %w", step, timeoutName, timeout, err)
+	}
+	return fmt.Errorf("%v: %w", step, err)
+}
+
+// duplicateStates are the SQLSTATEs Postgres returns for creating an object which already exists.
+var duplicateStates = map[string]bool{
+	"42P04": true, // duplicate_database
+	"42P06": true, // duplicate_schema
+	"42P07": true, // duplicate_table
+	"42710": true, // duplicate_object
+	"42723": true, // duplicate_function
+}
+
+// hintDuplicate suggests where an object set up failed to create might have come from.
+func hintDuplicate(err error) error {
+	var coded interface{ SQLState() string }
+	if errors.As(err, &coded) && duplicateStates[coded.SQLState()] ||
+		// MySQL and SQLite only say so in their messages
+		strings.Contains(err.Error(), "already exists") {
+		return fmt.Errorf("%w; it may have been created by an earlier set up step, or left behind by a failed clean up", err)
+	}
+	return err
+}
+
+func connect(ctx context.Context, cfg Config) (*sql.DB, error) {
+	for attempt := 1; ; attempt++ {
+		db, err := connectOnce(ctx, cfg)
+		if err == nil {
+			return db, nil
+		}
+		if attempt > cfg.ConnectRetries {
+			return nil, err
+		}
+		logEvent(
+			cfg.Logger,
+			"connection attempt failed",
+			[]interface{}{"attempt", attempt, "attempts", cfg.ConnectRetries + 1, "error", err},
+			"connection attempt %d of %d failed: %v", attempt, cfg.ConnectRetries+1, err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(cfg.ConnectRetryInterval):
+		}
+	}
+}
+
+func connectOnce(ctx context.Context, cfg Config) (*sql.DB, error) {
+	db := cfg.DB
+	switch {
+	case db != nil:
+	case cfg.Connector != nil:
+		db = sql.OpenDB(cfg.Connector)
+	case cfg.ConnectFuncCtx != nil:
+		var err error
+		if db, err = cfg.ConnectFuncCtx(ctx); err != nil {
+			return nil, fmt.Errorf("unable to connect: %w", err)
+		}
+	default:
+		var err error
+		if db, err = cfg.ConnectFunc(); err != nil {
+			return nil, fmt.Errorf("unable to connect: %w", err)
+		}
 	}
 
-	parts := strings.SplitN(dsn, ":", 2)
-	if len(parts) != 2 {
-		return nil, errors.New(`expected GOTESTING_URL="DRIVER:DSN_INFORMATION"`)
+	if cfg.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	}
 
-	return sql.Open(parts[0], parts[1])
+	if err := db.PingContext(ctx); err != nil {
+		if cfg.DB == nil {
+			if err := db.Close(); err != nil {
+				cfg.Logger.Printf("db.Close: %v", err)
+			}
+		}
+		return nil, fmt.Errorf("db.PingContext: %w", err)
+	}
+	return db, nil
+}
+
+// DefaultLogger returns the Logger used where Config leaves it nil, writing to stderr with each line prefixed by
+// prefix, or else by "dbtesting: ".
+func DefaultLogger(prefix string) *log.Logger {
+	if prefix == "" {
+		prefix = defaultLogPrefix
+	}
+	return log.New(os.Stderr, prefix, log.LstdFlags)
 }
 
 func defaultSetUp(context.Context, *sql.DB) error {
@@ -167,8 +1681,5 @@ func defaultCleanUp(context.Context, *sql.DB) error {
 }
 
 func defaultSkip() bool {
-	if !flag.Parsed() {
-		flag.Parse()
-	}
 	return testing.Short()
 }
@@ -0,0 +1,1209 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type runFunc func() int
+
+func (f runFunc) Run() int {
+	return f()
+}
+
+func TestRunZeroConfig(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	cfg, err := withDefaults(Config{DB: saved.DB})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+
+	var ran bool
+	code, err := state.runTests(runFunc(func() int {
+		ran = true
+		return 0
+	}), cfg)
+	if code != 0 || err != nil {
+		t.Fatalf("runTests returned %d, %v", code, err)
+	}
+	if !ran {
+		t.Fatal("expected the tests to have been run")
+	}
+}
+
+func TestRunSkipOnConnectError(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	cfg, err := withDefaults(Config{
+		ConnectFunc:        func() (*sql.DB, error) { return nil, errors.New("no database") },
+		SkipOnConnectError: true,
+		Logger:             log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	cfg.SkipReasonFunc = func() (bool, string) { return false, "" }
+
+	code, err := state.runTests(runFunc(func() int {
+		return 0
+	}), cfg)
+	if code != 0 || err != nil {
+		t.Fatalf("runTests returned %d, %v", code, err)
+	}
+	if !state.Skip || !strings.Contains(state.SkipReason, "no database") {
+		t.Fatalf("expected tests to be skipped with the connect error but got %v, %q", state.Skip, state.SkipReason)
+	}
+}
+
+func TestStepError(t *testing.T) {
+	ctx, cncl := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cncl()
+	<-ctx.Done()
+
+	err := stepError(ctx, nil, "SetUpFunc", "SetUpTimeout", 10*time.Second, errors.New("pq: canceling statement due to user request"))
+	if want := "SetUpFunc exceeded SetUpTimeout (10s): pq: canceling statement due to user request"; err.Error() != want {
+		t.Fatalf("expected %q but got %q", want, err)
+	}
+
+	err = stepError(context.Background(), nil, "SetUpFunc", "SetUpTimeout", 10*time.Second, errors.New("syntax error"))
+	if want := "SetUpFunc: syntax error"; err.Error() != want {
+		t.Fatalf("expected %q but got %q", want, err)
+	}
+
+	cause := errors.New("duplicate key value violates unique constraint")
+	classify := func(error) string { return "23505 films_pkey" }
+	err = stepError(context.Background(), classify, "SetUpFunc", "SetUpTimeout", 10*time.Second, cause)
+	if want := "SetUpFunc: duplicate key value violates unique constraint (23505 films_pkey)"; err.Error() != want {
+		t.Fatalf("expected %q but got %q", want, err)
+	}
+	if !errors.Is(err, cause) {
+		t.Fatalf("expected %v to wrap %v", err, cause)
+	}
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestHintDuplicate(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		hint bool
+	}{
+		{fmt.Errorf("SetUpFunc: %w", sqlStateError("42P07")), true},
+		{errors.New("SetUpFunc: table films already exists"), true},
+		{fmt.Errorf("SetUpFunc: %w", sqlStateError("42601")), false},
+		{errors.New("SetUpFunc: syntax error"), false},
+	} {
+		err := hintDuplicate(c.err)
+		if hinted := err.Error() != c.err.Error(); hinted != c.hint {
+			t.Errorf("hintDuplicate(%q) = %q; expected a hint %v", c.err, err, c.hint)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("expected %v to wrap %v", err, c.err)
+		}
+	}
+}
+
+func TestFlagsRegistered(t *testing.T) {
+	Flags.VisitAll(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) == nil {
+			t.Errorf("expected -%v to be registered on the command line", f.Name)
+		}
+	})
+}
+
+func TestQueryCtx(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	tt := &T{T: t, Ctx: context.Background(), state: &state}
+
+	state.QueryTimeout = 0
+	ctx, cncl := tt.QueryCtx()
+	defer cncl()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("expected no deadline without Config.QueryTimeout")
+	}
+
+	state.QueryTimeout = time.Minute
+	ctx, cncl = tt.QueryCtx()
+	defer cncl()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Fatalf("expected a deadline within Config.QueryTimeout but got %v", deadline)
+	}
+}
+
+func TestAfterEachTest(t *testing.T) {
+	var got *T
+	s := &settings{Config: Config{AfterEachTest: func(t *T) error { got = t; return nil }}}
+	tt := &T{T: t, Ctx: context.Background(), state: s}
+
+	tt.afterEachTest()
+	if got != tt {
+		t.Fatalf("expected AfterEachTest to be called with the test")
+	}
+}
+
+func TestInjectOn(t *testing.T) {
+	saved := state.Named
+	defer func() {
+		state.Named = saved
+	}()
+	state.Named = map[string]*sql.DB{"other": state.DB}
+
+	t.Run("other", InjectOn("other", func(t *T) {
+		if t.DB("other") != t.Tx {
+			t.Fatal("expected DB to return the transaction begun by InjectOn")
+		}
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'other', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+		t.AssertCount(`SELECT count(*) FROM films;`, 1)
+	}))
+}
+
+func TestSkipUnlessDB(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+	state.Skip, state.SkipReason = true, "skipping in short mode"
+
+	var ran bool
+	t.Run("skipped", func(t *testing.T) {
+		SkipUnlessDB(t)
+		ran = true
+	})
+	if ran {
+		t.Fatal("expected SkipUnlessDB to skip the test")
+	}
+
+	if err := state.mustRun(); err == nil || !strings.Contains(err.Error(), "skipping in short mode") {
+		t.Fatalf("expected InjectAlways to fail with the reason for skipping but got %v", err)
+	}
+}
+
+func TestNotRun(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+	state = settings{}
+
+	if _, _, err := BeginTest(t); !errors.Is(err, errNotRun) {
+		t.Fatalf("expected %v but got %v", errNotRun, err)
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	cfg, err := withDefaults(Config{})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	cfg.SkipReasonFunc = func() (bool, string) { return true, "skipping" }
+
+	var skipped bool
+	if _, err := state.runTests(runFunc(func() int {
+		skipped = Skipped()
+		return 0
+	}), cfg); err != nil {
+		t.Fatalf("runTests: %v", err)
+	}
+	if !skipped {
+		t.Fatal("expected Skipped to report the skip decided by SkipReasonFunc")
+	}
+}
+
+func TestReplicaDSN(t *testing.T) {
+	cfg, err := withDefaults(Config{ReplicaDSN: "postgres:host=replica", Databases: map[string]DatabaseConfig{"analytics": {}}})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if dc, ok := cfg.Databases[replicaName]; !ok || dc.TxOptions == nil || !dc.TxOptions.ReadOnly {
+		t.Fatalf("expected a read only replica database but got %+v", cfg.Databases)
+	}
+	if _, ok := cfg.Databases["analytics"]; !ok {
+		t.Fatal("expected the configured databases to be kept")
+	}
+
+	if _, err := withDefaults(Config{ReplicaDSN: "postgres:host=replica", Databases: map[string]DatabaseConfig{replicaName: {}}}); err == nil {
+		t.Fatal("expected an error when Config.Databases already has a replica")
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	cfg, err := withDefaults(Config{})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if cfg.Strategy != StrategyTransaction {
+		t.Fatalf("expected %q by default but got %q", StrategyTransaction, cfg.Strategy)
+	}
+
+	t.Setenv(strategyEnvVar, "truncate")
+	if cfg, err = withDefaults(Config{Strategy: StrategyTransaction}); err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if cfg.Strategy != StrategyTruncate {
+		t.Fatalf("expected %v to override Config.Strategy but got %q", strategyEnvVar, cfg.Strategy)
+	}
+	if _, err := withDefaults(Config{SuiteTransaction: true}); err == nil {
+		t.Fatal("expected an error combining SuiteTransaction with truncation")
+	}
+
+	t.Setenv(strategyEnvVar, "fresh")
+	if _, err := withDefaults(Config{}); err == nil {
+		t.Fatal("expected an error without a TemplateSetUpFunc")
+	}
+
+	t.Setenv(strategyEnvVar, "rollback")
+	if _, err := withDefaults(Config{}); err == nil {
+		t.Fatal("expected an error for an unknown strategy")
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	if p := DefaultLogger("").Prefix(); p != "dbtesting: " {
+		t.Fatalf("expected the default prefix to be separated from the timestamp but got %q", p)
+	}
+	cfg, err := withDefaults(Config{LogPrefix: "db| "})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if p := cfg.Logger.(*log.Logger).Prefix(); p != "db| " {
+		t.Fatalf("expected Config.LogPrefix but got %q", p)
+	}
+}
+
+func TestConnectionEnvVar(t *testing.T) {
+	conns := map[string]string{"local": "postgres://localhost/test", "ci": "postgres://ci/test"}
+	t.Setenv(connectionEnvVar, "ci")
+	cfg, err := withDefaults(Config{DSN: "postgres://localhost/other", Connections: conns})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if cfg.DSN != conns["ci"] {
+		t.Fatalf("expected %v to select the ci connection but got %q", connectionEnvVar, cfg.DSN)
+	}
+
+	t.Setenv(connectionEnvVar, "staging")
+	if _, err := withDefaults(Config{Connections: conns}); err == nil || !strings.Contains(err.Error(), "[ci local]") {
+		t.Fatalf("expected an error listing the connections but got %v", err)
+	}
+}
+
+func TestIsolationEnvVar(t *testing.T) {
+	t.Setenv(isolationEnvVar, "Serializable")
+	cfg, err := withDefaults(Config{TxOptions: &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true}})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if want := (sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true}); *cfg.TxOptions != want {
+		t.Fatalf("expected %v to override the isolation level but got %+v", isolationEnvVar, *cfg.TxOptions)
+	}
+
+	t.Setenv(isolationEnvVar, "read_committed")
+	if cfg, err = withDefaults(Config{}); err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if cfg.TxOptions.Isolation != sql.LevelReadCommitted {
+		t.Fatalf("expected %v but got %v", sql.LevelReadCommitted, cfg.TxOptions.Isolation)
+	}
+
+	t.Setenv(isolationEnvVar, "eventual")
+	if _, err := withDefaults(Config{}); err == nil || !strings.Contains(err.Error(), "repeatable_read") {
+		t.Fatalf("expected an error listing the levels but got %v", err)
+	}
+}
+
+// fakeConnector connects to nothing, for exercising runTests without a database.
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("unsupported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("unsupported") }
+
+// execConn executes anything without a database, for counting statements.
+type execConn struct{ fakeConn }
+
+func (execConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+type execConnector struct{ fakeConnector }
+
+func (execConnector) Connect(context.Context) (driver.Conn, error) { return execConn{}, nil }
+
+func TestCountQueries(t *testing.T) {
+	if _, err := withDefaults(Config{CountQueries: true, ConnectFunc: func() (*sql.DB, error) { return nil, nil }}); err == nil {
+		t.Fatal("expected an error counting the queries of a database opened by ConnectFunc")
+	}
+
+	cfg, err := withDefaults(Config{CountQueries: true, Connector: execConnector{}})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	db := sql.OpenDB(cfg.Connector)
+	defer db.Close()
+
+	before := atomic.LoadInt64(&totalQueries)
+	for i := 0; i < 3; i++ {
+		if _, err := db.Exec("UPDATE films SET title = 'counted'"); err != nil {
+			t.Fatalf("db.Exec: %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&totalQueries) - before; n != 3 {
+		t.Fatalf("expected 3 queries to be counted but got %d", n)
+	}
+}
+
+func TestQueriesOnTx(t *testing.T) {
+	var executed []string
+	cfg, err := withDefaults(Config{Connector: recordingConnector{executed: &executed}})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	db := sql.OpenDB(cfg.Connector)
+	defer db.Close()
+	s := &settings{DB: db, Initialized: true, Config: cfg}
+
+	t.Run("recorded", func(t *testing.T) {
+		inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+			if _, err := t.Tx.ExecContext(t.Ctx, "UPDATE films SET title = 'tx'"); err != nil {
+				t.Fatalf("t.Tx.ExecContext: %v", err)
+			}
+			t.Savepoint("", func(t *T) {
+				if _, err := t.Recorded().ExecContext(t.Ctx, "UPDATE films SET title = 'recorded'"); err != nil {
+					t.Fatalf("t.Recorded().ExecContext: %v", err)
+				}
+			})
+			expected := []string{"UPDATE films SET title = 'tx'", "UPDATE films SET title = 'recorded'"}
+			if queries := t.Queries(); !reflect.DeepEqual(queries, expected) {
+				t.Fatalf("expected %q to be recorded, once each and without the savepoint's, but got %q", expected, queries)
+			}
+		})
+	})
+}
+
+func TestVerbose(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	var buf strings.Builder
+	state.Verbose, state.Logger = true, log.New(&buf, "", 0)
+
+	db := sql.OpenDB(fakeConnector{})
+	defer db.Close()
+	if err := SQLStatements("CREATE TABLE films ()", "CREATE TABLE actors ()")(context.Background(), db); err == nil {
+		t.Fatal("expected the fake connection to fail")
+	}
+	if want := "statement 0: CREATE TABLE films ()\n"; buf.String() != want {
+		t.Fatalf("expected %q to be logged but got %q", want, buf.String())
+	}
+}
+
+func TestBeginRetries(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+	state.BeginRetries = 2
+
+	db := sql.OpenDB(fakeConnector{})
+	defer db.Close()
+	_, err := begin(t, context.Background(), &state, db, nil, TestConfig{}, &attempt{})
+	if err == nil || !strings.Contains(err.Error(), "retried 2 times") {
+		t.Fatalf("expected an error after retrying twice but got %v", err)
+	}
+}
+
+// txConn begins transactions, failing statements of "CONFLICT" with a serialization failure.
+type txConn struct {
+	execConn
+	begun *int
+}
+
+func (c txConn) Begin() (driver.Tx, error) {
+	*c.begun++
+	return txConn{}, nil
+}
+func (txConn) Commit() error   { return nil }
+func (txConn) Rollback() error { return nil }
+
+func (txConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if query == "CONFLICT" {
+		return nil, sqlStateError("40001")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type txConnector struct {
+	fakeConnector
+	begun *int
+}
+
+func (c txConnector) Connect(context.Context) (driver.Conn, error) {
+	return txConn{begun: c.begun}, nil
+}
+
+func TestTxRetries(t *testing.T) {
+	var begun int
+	db := sql.OpenDB(txConnector{begun: &begun})
+	defer db.Close()
+	s := &settings{Config: Config{
+		TxRetries:      2,
+		IsRetriable:    func(err error) bool { var e sqlStateError; return errors.As(err, &e) && e == "40001" },
+		CleanUpTimeout: time.Second,
+	}}
+
+	var (
+		attempts int
+		txs      []*sql.Tx
+	)
+	ok := t.Run("retried", func(t *testing.T) {
+		injectAttempts(t, context.Background(), s, db, nil, TestConfig{}, func(t *T) {
+			attempts++
+			txs = append(txs, t.Tx)
+			if attempts == 3 {
+				return
+			}
+			t.Errorf("failing attempt %d", attempts)
+			if _, err := t.Recorded().ExecContext(t.Ctx, "CONFLICT"); err != nil {
+				t.Fatalf("expected the attempt to be abandoned rather than see %v", err)
+			}
+		})
+	})
+	if !ok {
+		t.Fatal("expected the failures of abandoned attempts not to fail the test")
+	}
+	if attempts != 3 || begun != 3 {
+		t.Fatalf("expected 3 attempts in 3 transactions but got %d in %d", attempts, begun)
+	}
+	if txs[0] == txs[1] || txs[1] == txs[2] {
+		t.Fatal("expected each attempt to run in a fresh transaction")
+	}
+}
+
+func TestAdvisoryLockTwice(t *testing.T) {
+	var begun int
+	db := sql.OpenDB(txConnector{begun: &begun})
+	defer db.Close()
+	s := &settings{DB: db, Initialized: true, Config: Config{Driver: dialectSQLite, TestTimeout: time.Second, CleanUpTimeout: time.Second}}
+
+	for i := 0; i < 2; i++ {
+		t.Run("twice", func(t *testing.T) {
+			inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+				locked := make(chan struct{})
+				go func() {
+					defer close(locked)
+					t.AdvisoryLock(98)
+					t.AdvisoryLock(98)
+				}()
+				select {
+				case <-locked:
+				case <-time.After(time.Second):
+					t.Fatal("expected taking the same lock again to do nothing rather than deadlock")
+				}
+			})
+		})
+	}
+}
+
+func TestAfterConnect(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		cfg      func(driver.Connector) Config
+		expected int
+	}{
+		{"opened", func(c driver.Connector) Config { return Config{Connector: c} }, 1},
+		{"given", func(c driver.Connector) Config { return Config{DB: sql.OpenDB(c)} }, 3},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var begun, applied int
+			cfg := c.cfg(txConnector{begun: &begun})
+			cfg.AfterConnect = func(context.Context, *sql.Conn) error { applied++; return nil }
+			cfg, err := withDefaults(cfg)
+			if err != nil {
+				t.Fatalf("withDefaults: %v", err)
+			}
+			db := cfg.DB
+			if db == nil {
+				db = sql.OpenDB(cfg.Connector)
+			}
+			defer db.Close()
+			s := &settings{DB: db, Initialized: true, Config: cfg}
+
+			for i := 0; i < 3; i++ {
+				t.Run("inject", func(t *testing.T) {
+					inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+						if t.Conn == nil {
+							t.Fatal("expected the test to be dedicated a connection")
+						}
+					})
+				})
+			}
+			if applied != c.expected {
+				t.Fatalf("expected AfterConnect to be applied %d times on one connection but got %d", c.expected, applied)
+			}
+		})
+	}
+}
+
+// sqliteDriver stands in for a SQLite driver, recording the data sources it opens.
+type sqliteDriver struct{ opened chan string }
+
+func (d sqliteDriver) Open(name string) (driver.Conn, error) {
+	d.opened <- name
+	return fakeConn{}, nil
+}
+
+var fakeSQLite = sqliteDriver{make(chan string, 10)}
+
+func init() {
+	sql.Register("dbtesting_sqlite", fakeSQLite)
+}
+
+func TestSQLiteMemory(t *testing.T) {
+	saved := sqliteDrivers
+	defer func() {
+		sqliteDrivers = saved
+	}()
+	sqliteDrivers = []string{"dbtesting_sqlite"}
+
+	db, err := SQLiteMemory()()
+	if err != nil {
+		t.Fatalf("SQLiteMemory: %v", err)
+	}
+	defer db.Close()
+
+	// parallel tests each need a connection, which a pool of one would block
+	ctx, cncl := context.WithTimeout(context.Background(), time.Second)
+	defer cncl()
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("db.Conn: %v", err)
+		}
+		defer conn.Close()
+	}
+	for i := 0; i < 2; i++ {
+		if name := <-fakeSQLite.opened; !strings.HasPrefix(name, "file:dbtesting") || !strings.HasSuffix(name, "?mode=memory&cache=shared") {
+			t.Fatalf("expected a shared in-memory database but opened %q", name)
+		}
+	}
+}
+
+func TestSuiteTransaction(t *testing.T) {
+	SkipUnlessDB(t)
+
+	tx, err := state.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("db.BeginTx: %v", err)
+	}
+	saved := state.SuiteTx
+	defer func() {
+		state.SuiteTx = saved
+		if err := tx.Rollback(); err != nil {
+			t.Errorf("tx.Rollback: %v", err)
+		}
+	}()
+	state.SuiteTx = tx
+
+	t.Run("parallel", func(t *testing.T) {
+		for _, code := range []string{"abcde", "fghij", "klmno"} {
+			code := code
+			t.Run(code, func(t *testing.T) {
+				t.Parallel()
+				Inject(func(t *T) {
+					if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ($1, 'suite', 1);`, code); err != nil {
+						t.Fatalf("error inserting: %v", err)
+					}
+					// long enough for the others to interleave, were they able to
+					time.Sleep(10 * time.Millisecond)
+					t.AssertCount(`SELECT count(*) FROM films;`, 1)
+				})(t)
+			})
+		}
+	})
+	var n int
+	if err := tx.QueryRowContext(context.Background(), `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+		t.Fatalf("error counting: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected each test's savepoint to be rolled back but found %d films", n)
+	}
+}
+
+func TestSuiteTransactionParallel(t *testing.T) {
+	var begun int
+	db := sql.OpenDB(txConnector{begun: &begun})
+	defer db.Close()
+	suite, err := db.Begin()
+	if err != nil {
+		t.Fatalf("db.Begin: %v", err)
+	}
+	defer suite.Rollback()
+
+	for _, c := range []struct {
+		name    string
+		suiteTx *sql.Tx
+		fails   bool
+	}{
+		{"own transaction", nil, false},
+		{"suite transaction", suite, true},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := &settings{DB: db, Initialized: true, SuiteTx: c.suiteTx, Config: Config{TestTimeout: time.Second, CleanUpTimeout: time.Second}}
+			inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+				// pausing here would hold the suite's transaction from every other test
+				if reason := t.parallelUnsupported(); (reason != "") != c.fails {
+					t.Fatalf("expected Parallel to fail: %v, but got %q", c.fails, reason)
+				}
+			})
+		})
+	}
+}
+
+func TestGuardSchemaParallel(t *testing.T) {
+	SkipUnlessDB(t)
+
+	s := state
+	s.GuardSchema = true
+	defer func() {
+		if _, err := s.DB.Exec(`DROP TABLE IF EXISTS guarded_films;`); err != nil {
+			t.Errorf("error dropping: %v", err)
+		}
+	}()
+
+	// neither test can tell which of them created the table
+	done := s.guardSchema(t)
+	t.Run("concurrent", func(t *testing.T) {
+		defer s.guardSchema(t)()
+		if _, err := s.DB.Exec(`CREATE TABLE guarded_films (code char(5));`); err != nil {
+			t.Fatalf("error creating: %v", err)
+		}
+	})
+	done()
+}
+
+func TestIsolatedSchema(t *testing.T) {
+	SkipUnlessDB(t)
+
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	cfg, err := withDefaults(Config{
+		DB:            state.DB,
+		IsolateSchema: true,
+		SetUpFunc: func(ctx context.Context, db *sql.DB) error {
+			_, err := db.ExecContext(ctx, "CREATE TABLE "+IsolatedSchema()+".isolated_films (code char(5));")
+			return err
+		},
+		SkipReasonFunc: func() (bool, string) { return false, "" },
+		Logger:         log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	code, err := state.runTests(runFunc(func() int {
+		t.Run("inject", Inject(func(t *T) {
+			if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO isolated_films (code) VALUES ('abcde');`); err != nil {
+				t.Fatalf("expected the test to find the table set up in its schema: %v", err)
+			}
+			t.AssertCount(`SELECT count(*) FROM isolated_films;`, 1)
+		}))
+		return 0
+	}), cfg)
+	if code != 0 || err != nil {
+		t.Fatalf("expected the tests to run but got %d, %v", code, err)
+	}
+}
+
+func TestWrites(t *testing.T) {
+	t.Run("writes", Inject(func(t *T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		for _, c := range []struct {
+			name, query, changed string
+		}{
+			{"insert", `INSERT INTO films (code, title, did) VALUES ('fghij', 'second', 2);`, "+ fghij\tsecond"},
+			{"update", `UPDATE films SET title = 'changed' WHERE code = 'abcde';`, "+ abcde\tchanged"},
+		} {
+			writes := t.writes("AssertNoWrites", []string{"films"}, func() {
+				if _, err := t.Tx.ExecContext(t.Ctx, c.query); err != nil {
+					t.Fatalf("%v: %v", c.name, err)
+				}
+			})
+			if len(writes) != 1 || !strings.HasPrefix(writes[0], "films changed:") || !strings.Contains(writes[0], c.changed) {
+				t.Fatalf("%v: expected the change to films to be described but got %q", c.name, writes)
+			}
+		}
+	}))
+}
+
+func TestRunCleanUpOnSetUpFailure(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		keep := keep
+		t.Run(fmt.Sprint(keep), func(t *testing.T) {
+			saved := state
+			defer func() {
+				state = saved
+			}()
+
+			var cleaned bool
+			cfg, err := withDefaults(Config{
+				Connector:         fakeConnector{},
+				Driver:            dialectPostgres,
+				SetUpFunc:         func(context.Context, *sql.DB) error { return errors.New("fourth table") },
+				CleanUpFunc:       func(context.Context, *sql.DB) error { cleaned = true; return nil },
+				KeepSetUpFailures: keep,
+				Logger:            log.New(io.Discard, "", 0),
+			})
+			if err != nil {
+				t.Fatalf("withDefaults: %v", err)
+			}
+			cfg.SkipReasonFunc = func() (bool, string) { return false, "" }
+
+			if code, err := state.runTests(runFunc(func() int { return 0 }), cfg); code != 1 || err == nil {
+				t.Fatalf("expected runTests to fail but got %d, %v", code, err)
+			}
+			if cleaned == keep {
+				t.Fatalf("expected CleanUpFunc to have run %v but got %v", !keep, cleaned)
+			}
+		})
+	}
+}
+
+func TestRunTearDownFunc(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	var (
+		order   []string
+		pingErr error
+	)
+	cfg, err := withDefaults(Config{
+		ConnectFunc: func() (*sql.DB, error) {
+			return sql.OpenDB(fakeConnector{}), nil
+		},
+		Driver:       dialectPostgres,
+		CleanUpFunc:  func(context.Context, *sql.DB) error { order = append(order, "CleanUpFunc"); return nil },
+		TearDownFunc: func() { order = append(order, "TearDownFunc"); pingErr = state.DB.Ping() },
+		Logger:       log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	cfg.SkipReasonFunc = func() (bool, string) { return false, "" }
+
+	if code, err := state.runTests(runFunc(func() int { return 0 }), cfg); code != 0 || err != nil {
+		t.Fatalf("expected runTests to succeed but got %d, %v", code, err)
+	}
+	if want := []string{"CleanUpFunc", "TearDownFunc"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("expected %v but got %v", want, order)
+	}
+	if pingErr == nil || !strings.Contains(pingErr.Error(), "closed") {
+		t.Fatalf("expected the database to be closed before TearDownFunc but got %v", pingErr)
+	}
+}
+
+func TestRunEach(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	var drivers, runs []string
+	cfg := func(driver string) Config {
+		return Config{
+			Connector:      fakeConnector{},
+			Driver:         driver,
+			SkipReasonFunc: func() (bool, string) { return false, "" },
+			Logger:         log.New(io.Discard, "", 0),
+		}
+	}
+	m := runFunc(func() int {
+		drivers, runs = append(drivers, state.Driver), append(runs, state.Run)
+		if state.Driver == dialectMySQL {
+			return 3
+		}
+		return 0
+	})
+
+	if code := runEach(m, []Config{cfg(dialectPostgres), cfg(dialectMySQL), cfg(dialectSQLite)}); code != 3 {
+		t.Fatalf("expected the failing run's exit code but got %d", code)
+	}
+	if want := []string{dialectPostgres, dialectMySQL, dialectSQLite}; !reflect.DeepEqual(drivers, want) {
+		t.Fatalf("expected runs against %v but got %v", want, drivers)
+	}
+	if want := []string{"run 1 of 3", "run 2 of 3", "run 3 of 3"}; !reflect.DeepEqual(runs, want) {
+		t.Fatalf("expected tests to be told of %v but got %v", want, runs)
+	}
+}
+
+func TestRunFailOnCleanUpError(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		fail := fail
+		t.Run(fmt.Sprint(fail), func(t *testing.T) {
+			saved := state
+			defer func() {
+				state = saved
+			}()
+
+			cfg, err := withDefaults(Config{
+				Connector:          fakeConnector{},
+				Driver:             dialectPostgres,
+				SetUpFunc:          func(context.Context, *sql.DB) error { return nil },
+				CleanUpFunc:        func(context.Context, *sql.DB) error { return errors.New("dirty") },
+				FailOnCleanUpError: fail,
+				Logger:             log.New(io.Discard, "", 0),
+			})
+			if err != nil {
+				t.Fatalf("withDefaults: %v", err)
+			}
+			cfg.SkipReasonFunc = func() (bool, string) { return false, "" }
+
+			expected := 0
+			if fail {
+				expected = 1
+			}
+			if code, err := state.runTests(runFunc(func() int { return 0 }), cfg); code != expected || err != nil {
+				t.Fatalf("expected runTests to return %d, nil but got %d, %v", expected, code, err)
+			}
+		})
+	}
+}
+
+// recordingConn executes anything without a database, recording the statements.
+type recordingConn struct {
+	fakeConn
+	executed *[]string
+}
+
+func (c recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	*c.executed = append(*c.executed, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c recordingConn) Begin() (driver.Tx, error) {
+	*c.executed = append(*c.executed, "BEGIN")
+	return c, nil
+}
+
+func (c recordingConn) Commit() error {
+	*c.executed = append(*c.executed, "COMMIT")
+	return nil
+}
+
+func (c recordingConn) Rollback() error {
+	*c.executed = append(*c.executed, "ROLLBACK")
+	return nil
+}
+
+type recordingConnector struct {
+	fakeConnector
+	executed *[]string
+}
+
+func (c recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{executed: c.executed}, nil
+}
+
+func TestValidate(t *testing.T) {
+	initialized := state.Initialized
+	for _, c := range []struct {
+		name     string
+		driver   string
+		setUp    error
+		cleanUp  error
+		expected string
+		executed []string
+	}{
+		{"valid", dialectPostgres, nil, nil, "", []string{"BEGIN", "SET UP", "SAVEPOINT", "RELEASE SAVEPOINT", "CLEAN UP", "ROLLBACK"}},
+		{"set up", dialectPostgres, errors.New("syntax error"), nil, "SetUpFunc: syntax error", []string{"BEGIN", "SET UP", "SAVEPOINT", "RELEASE SAVEPOINT", "ROLLBACK"}},
+		{"clean up", dialectSQLite, nil, errors.New("no such table"), "CleanUpFunc: no such table", []string{"BEGIN", "SET UP", "SAVEPOINT", "RELEASE SAVEPOINT", "CLEAN UP", "ROLLBACK"}},
+		{"without transactional DDL", dialectMySQL, nil, nil, "", []string{"SET UP", "CLEAN UP"}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var executed []string
+			err := Validate(Config{
+				Connector: recordingConnector{executed: &executed},
+				Driver:    c.driver,
+				SetUpFunc: func(ctx context.Context, db *sql.DB) error {
+					if _, err := db.ExecContext(ctx, "SET UP"); err != nil {
+						return err
+					}
+					if c.driver != dialectMySQL {
+						// transactions begun by the set up are savepoints
+						tx, err := db.BeginTx(ctx, nil)
+						if err != nil {
+							return err
+						}
+						if err := tx.Commit(); err != nil {
+							return err
+						}
+					}
+					return c.setUp
+				},
+				CleanUpFunc: func(ctx context.Context, db *sql.DB) error {
+					if _, err := db.ExecContext(ctx, "CLEAN UP"); err != nil {
+						return err
+					}
+					return c.cleanUp
+				},
+				OnTiming: func(string, time.Duration) {},
+				Logger:   log.New(io.Discard, "", 0),
+			})
+			if c.expected == "" && err != nil {
+				t.Fatalf("expected no error but got %v", err)
+			}
+			if c.expected != "" && (err == nil || !strings.Contains(err.Error(), c.expected)) {
+				t.Fatalf("expected an error containing %q but got %v", c.expected, err)
+			}
+			for i, query := range executed {
+				// savepoints are numbered
+				if j := strings.Index(query, " dbtesting_"); j >= 0 {
+					executed[i] = query[:j]
+				}
+			}
+			if !reflect.DeepEqual(executed, c.executed) {
+				t.Fatalf("expected %q to be executed but got %q", c.executed, executed)
+			}
+			if state.Initialized != initialized {
+				t.Fatal("expected Validate to leave the package's state as it was")
+			}
+		})
+	}
+}
+
+func TestValidateConnectError(t *testing.T) {
+	err := Validate(Config{
+		ConnectFunc:        func() (*sql.DB, error) { return nil, errors.New("connection refused") },
+		SkipOnConnectError: true,
+		Logger:             log.New(io.Discard, "", 0),
+	})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected the connection error rather than a skip but got %v", err)
+	}
+}
+
+func TestValidateVerbose(t *testing.T) {
+	var (
+		buf      strings.Builder
+		executed []string
+	)
+	err := Validate(Config{
+		Connector:   recordingConnector{executed: &executed},
+		Driver:      dialectMySQL,
+		SetUpFunc:   SQL("SET UP"),
+		CleanUpFunc: SQL("CLEAN UP"),
+		Verbose:     true,
+		OnTiming:    func(string, time.Duration) {},
+		Logger:      log.New(&buf, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if !strings.Contains(buf.String(), "SET UP\n") || !strings.Contains(buf.String(), "CLEAN UP\n") {
+		t.Fatalf("expected the set up and clean up to be logged but got %q", buf.String())
+	}
+}
+
+func TestAutonomousFreshDatabase(t *testing.T) {
+	var executed []string
+	db := sql.OpenDB(recordingConnector{executed: &executed})
+	defer db.Close()
+	s := &settings{DB: db, Initialized: true, Template: "template", Config: Config{
+		Strategy: StrategyFreshDatabase,
+		ConnectDatabaseFunc: func(string) (*sql.DB, error) {
+			return sql.OpenDB(recordingConnector{executed: &executed}), nil
+		},
+		TestTimeout:    time.Second,
+		CleanUpTimeout: time.Second,
+	}}
+
+	t.Run("autonomous", func(t *testing.T) {
+		inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+			t.Autonomous(func(ctx context.Context, conn *sql.Conn) error {
+				_, err := conn.ExecContext(ctx, "DO")
+				return err
+			}, func(ctx context.Context, conn *sql.Conn) error {
+				_, err := conn.ExecContext(ctx, "UNDO")
+				return err
+			})
+		})
+	})
+	for i, query := range executed {
+		// the fresh database's name is random
+		if j := strings.Index(query, " dbtesting_"); j >= 0 {
+			executed[i] = query[:j]
+		}
+	}
+	// undone in the test's own database, after its rollback but before it's dropped
+	expected := []string{"CREATE DATABASE", "BEGIN", "DO", "ROLLBACK", "UNDO", "DROP DATABASE IF EXISTS"}
+	if !reflect.DeepEqual(executed, expected) {
+		t.Fatalf("expected %q to be executed but got %q", expected, executed)
+	}
+}
+
+// recordingDriver opens recordingConns, for databases opened by DSN.
+type recordingDriver struct{}
+
+func (recordingDriver) Open(string) (driver.Conn, error) {
+	return recordingConn{executed: new([]string)}, nil
+}
+
+func init() {
+	sql.Register("dbtesting_recording", recordingDriver{})
+}
+
+func TestCountQueriesFreshDatabase(t *testing.T) {
+	if _, err := withDefaults(Config{
+		CountQueries:        true,
+		Connector:           execConnector{},
+		TemplateSetUpFunc:   func(context.Context, *sql.DB) error { return nil },
+		ConnectDatabaseFunc: func(string) (*sql.DB, error) { return nil, nil },
+	}); err == nil {
+		t.Fatal("expected an error counting the queries of fresh databases opened by ConnectDatabaseFunc")
+	}
+
+	var executed []string
+	cfg, err := withDefaults(Config{
+		CountQueries:      true,
+		Connector:         recordingConnector{executed: &executed},
+		DSN:               "dbtesting_recording:primary",
+		Strategy:          StrategyFreshDatabase,
+		TemplateSetUpFunc: func(context.Context, *sql.DB) error { return nil },
+	})
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	db := sql.OpenDB(cfg.Connector)
+	defer db.Close()
+	s := &settings{DB: db, Initialized: true, Template: "template", Config: cfg}
+
+	t.Run("counted", func(t *testing.T) {
+		inject(context.Background(), s, t, TestConfig{}, func(t *T) {
+			for i := 0; i < 3; i++ {
+				if _, err := t.Tx.ExecContext(t.Ctx, "UPDATE films SET title = 'counted'"); err != nil {
+					t.Fatalf("t.Tx.ExecContext: %v", err)
+				}
+			}
+			if n := t.TotalQueries(); n != 3 {
+				t.Fatalf("expected the fresh database's 3 queries to be counted but got %d", n)
+			}
+		})
+	})
+}
+
+func TestParseVersion(t *testing.T) {
+	for v, expected := range map[string][]int{
+		"16.2 (Debian 16.2-1.pgdg120+2)": {16, 2},
+		"8.0.33-0ubuntu0.22.04.2":        {8, 0, 33},
+		"3.45.1":                         {3, 45, 1},
+		"17beta1":                        {17},
+		"unknown":                        nil,
+	} {
+		if got := parseVersion(v); !reflect.DeepEqual(got, expected) {
+			t.Errorf("parseVersion(%q): expected %v but got %v", v, expected, got)
+		}
+	}
+
+	for _, c := range []string{"14", ">= 14", "<8.0.30", "= 3.35"} {
+		if _, _, err := parseConstraint(c); err != nil {
+			t.Errorf("parseConstraint(%q): %v", c, err)
+		}
+	}
+	for _, c := range []string{"", ">=", "~> 14", "14.x"} {
+		if _, _, err := parseConstraint(c); err == nil {
+			t.Errorf("parseConstraint(%q): expected an error", c)
+		}
+	}
+}
+
+func TestInsertQuery(t *testing.T) {
+	row := map[string]interface{}{"title": "first", "code": "abcde"}
+	for _, c := range []struct {
+		dialect  string
+		fix      Fixture
+		expected string
+	}{
+		{dialectPostgres, Fixture{Table: "films"}, "INSERT INTO films (code, title) VALUES ($1, $2)"},
+		{dialectPostgres, Fixture{Table: "films", Upsert: true}, "INSERT INTO films (code, title) VALUES ($1, $2) ON CONFLICT DO NOTHING"},
+		{dialectSQLite, Fixture{Table: "films", Upsert: true, ConflictColumns: []string{"code"}}, "INSERT INTO films (code, title) VALUES (?, ?) ON CONFLICT (code) DO NOTHING"},
+		{dialectMySQL, Fixture{Table: "films", Upsert: true}, "INSERT IGNORE INTO films (code, title) VALUES (?, ?)"},
+	} {
+		query, args, err := insertQuery(c.dialect, c.fix, row)
+		if err != nil {
+			t.Fatalf("insertQuery(%v, %+v): %v", c.dialect, c.fix, err)
+		}
+		if query != c.expected || !reflect.DeepEqual(args, []interface{}{"abcde", "first"}) {
+			t.Errorf("insertQuery(%v, %+v) = %q, %v; expected %q", c.dialect, c.fix, query, args, c.expected)
+		}
+	}
+
+	if _, _, err := insertQuery("oracle", Fixture{Table: "films", Upsert: true}, row); err == nil {
+		t.Error("expected Upsert to be unsupported for an unknown driver")
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	var want, got interface{}
+	_ = json.Unmarshal([]byte(`{"a": {"b": 1, "c": [1, 2]}, "d": "x"}`), &want)
+	_ = json.Unmarshal([]byte(`{"a": {"b": 2, "c": [1]}, "e": true}`), &got)
+
+	diffs := diffJSON("$", want, got, nil)
+	expected := []string{
+		"$.a.b: expected 1 but got 2",
+		"$.a.c: expected 2 elements but got 1",
+		"$.d: missing",
+		"$.e: unexpected true",
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Fatalf("expected %q but got %q", expected, diffs)
+	}
+}
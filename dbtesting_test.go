@@ -2,9 +2,15 @@ package dbtesting_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/jwilner/dbtesting"
 	"os"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	// include PQ postgres driver
 	_ "github.com/lib/pq"
@@ -25,9 +31,12 @@ CREATE TABLE films (
 		CleanUpFunc: dbtesting.SQL(`
 DROP TABLE films;
 `),
+		TxContextKey: txKey{},
 	}))
 }
 
+type txKey struct{}
+
 func TestPretend(t *testing.T) {
 	t.Run("pretend", dbtesting.Inject(func(t *dbtesting.T) {
 		var code, title = "abcde", "random title"
@@ -66,3 +75,446 @@ func TestPretend(t *testing.T) {
 		}
 	}))
 }
+
+func TestContext(t *testing.T) {
+	var ctx context.Context
+	t.Run("deadline", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, ok := t.Ctx.Deadline(); !ok {
+			t.Fatal("expected the test context to have a deadline")
+		}
+		ctx = t.Ctx
+	}))
+	if ctx != nil && ctx.Err() == nil {
+		t.Fatal("expected the test context to be cancelled once the test completed")
+	}
+}
+
+func TestInjectWithOptions(t *testing.T) {
+	t.Run("read only", dbtesting.InjectWithOptions(&sql.TxOptions{ReadOnly: true}, func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err == nil {
+			t.Fatal("expected an insert in a read only transaction to fail")
+		}
+	}))
+
+	t.Run("serializable", dbtesting.InjectWithOptions(&sql.TxOptions{Isolation: sql.LevelSerializable}, func(t *dbtesting.T) {
+		var level string
+		if err := t.Tx.QueryRowContext(t.Ctx, `SHOW transaction_isolation;`).Scan(&level); err != nil {
+			t.Fatalf("error reading isolation level: %v", err)
+		}
+		if level != "serializable" {
+			t.Fatalf("expected serializable isolation but got %#v", level)
+		}
+	}))
+}
+
+func TestSavepoint(t *testing.T) {
+	t.Run("nested", dbtesting.Inject(func(t *dbtesting.T) {
+		insert := func(t *dbtesting.T, code string) {
+			if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ($1, 'title', 1);`, code); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+		}
+		count := func(t *dbtesting.T) (n int) {
+			if err := t.Tx.QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+				t.Fatalf("error counting: %v", err)
+			}
+			return n
+		}
+
+		insert(t, "aaaaa")
+		t.Savepoint("", func(t *dbtesting.T) {
+			insert(t, "bbbbb")
+			t.Savepoint("inner", func(t *dbtesting.T) {
+				insert(t, "ccccc")
+				if n := count(t); n != 3 {
+					t.Fatalf("expected 3 rows but found %d", n)
+				}
+			})
+			if n := count(t); n != 2 {
+				t.Fatalf("expected 2 rows but found %d", n)
+			}
+		})
+		if n := count(t); n != 1 {
+			t.Fatalf("expected 1 row but found %d", n)
+		}
+	}))
+}
+
+func TestParallel(t *testing.T) {
+	for _, code := range []string{"aaaaa", "bbbbb", "ccccc"} {
+		code := code
+		t.Run(code, func(t *testing.T) {
+			t.Parallel()
+			dbtesting.Inject(func(t *dbtesting.T) {
+				if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ($1, 'title', 1);`, code); err != nil {
+					t.Fatalf("error inserting: %v", err)
+				}
+			})(t)
+		})
+	}
+}
+
+func TestInjectDB(t *testing.T) {
+	t.Run("insert", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		if _, err := t.DB.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}))
+
+	t.Run("reset", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		var n int
+		if err := t.DB.QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+			t.Fatalf("error counting: %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("expected films to have been truncated but found %d rows", n)
+		}
+	}))
+}
+
+func TestQueries(t *testing.T) {
+	t.Run("recorded", dbtesting.Inject(func(t *dbtesting.T) {
+		insert := `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`
+		if _, err := t.Recorded().ExecContext(t.Ctx, insert); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+		if _, err := t.Tx.ExecContext(t.Ctx, `SELECT 1;`); err != nil {
+			t.Fatalf("error selecting: %v", err)
+		}
+		t.Savepoint("", func(t *dbtesting.T) {
+			var n int
+			if err := t.Recorded().QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+				t.Fatalf("error counting: %v", err)
+			}
+		})
+		// run by a helper, so not recorded
+		t.AssertCount(`SELECT count(*) FROM films;`, 1)
+
+		if queries := t.Queries(); !reflect.DeepEqual(queries, []string{insert, `SELECT 1;`, `SELECT count(*) FROM films;`}) {
+			t.Fatalf("unexpected queries: %#v", queries)
+		}
+	}))
+}
+
+func TestInjectWith(t *testing.T) {
+	var ran, cleanedUp bool
+	t.Run("hooks", dbtesting.InjectWith(dbtesting.TestConfig{
+		SetUp: func(t *dbtesting.T) error {
+			_, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`)
+			return err
+		},
+		CleanUp: func(t *dbtesting.T) error {
+			cleanedUp = true
+			var n int
+			if err := t.Tx.QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+				return err
+			}
+			if n != 2 {
+				return fmt.Errorf("expected the transaction to be open with 2 rows but found %d", n)
+			}
+			return nil
+		},
+	}, func(t *dbtesting.T) {
+		ran = true
+		t.AssertCount(`SELECT count(*) FROM films;`, 1)
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('fghij', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}))
+	if ran && !cleanedUp {
+		t.Fatal("expected the clean up hook to have run")
+	}
+}
+
+func TestInjectNoTx(t *testing.T) {
+	t.Run("concurrently", dbtesting.InjectNoTx(func(t *dbtesting.TConn) {
+		if _, err := t.Conn.ExecContext(t.Ctx, `CREATE INDEX CONCURRENTLY films_title ON films (title);`); err != nil {
+			t.Fatalf("error creating index: %v", err)
+		}
+		if _, err := t.Conn.ExecContext(t.Ctx, `DROP INDEX CONCURRENTLY films_title;`); err != nil {
+			t.Fatalf("error dropping index: %v", err)
+		}
+	}))
+}
+
+func TestNewTx(t *testing.T) {
+	dbtesting.Inject(func(t *dbtesting.T) {
+		tryLock := func(tx *sql.Tx) (locked bool) {
+			t.Helper()
+			if err := tx.QueryRowContext(t.Ctx, `SELECT pg_try_advisory_xact_lock(64);`).Scan(&locked); err != nil {
+				t.Fatalf("pg_try_advisory_xact_lock: %v", err)
+			}
+			return locked
+		}
+
+		first, release, err := t.NewTx()
+		if err != nil {
+			t.Fatalf("NewTx: %v", err)
+		}
+		second, _, err := t.NewTx()
+		if err != nil {
+			t.Fatalf("NewTx: %v", err)
+		}
+
+		if !tryLock(first) {
+			t.Fatalf("expected the first transaction to take the lock")
+		}
+		if tryLock(second) {
+			t.Fatalf("expected the second transaction to be locked out")
+		}
+		release()
+		if !tryLock(second) {
+			t.Fatalf("expected the second transaction to take the lock once the first was rolled back")
+		}
+	})(t)
+}
+
+func TestHarness(t *testing.T) {
+	dbtesting.SkipUnlessDB(t)
+	driverName, source, err := dbtesting.ResolveDSN("", "")
+	if err != nil {
+		t.Fatalf("ResolveDSN: %v", err)
+	}
+	db, err := sql.Open(driverName, source)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	h := dbtesting.New(db)
+	for i := 0; i < 2; i++ {
+		t.Run("films", h.Inject(func(t *dbtesting.T) {
+			t.AssertCount(`SELECT count(*) FROM films;`, 0)
+			if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+		}))
+	}
+}
+
+func TestVisible(t *testing.T) {
+	t.Run("visible", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.RunTx("subtest", func(t *dbtesting.T) {
+			t.Visible(func(tx *sql.Tx) {
+				var n int
+				if err := tx.QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+					t.Fatalf("error counting: %v", err)
+				}
+				if n != 1 {
+					t.Fatalf("expected the test's insert to be visible but got %d rows", n)
+				}
+			})
+		})
+	}))
+}
+
+func TestTxContextKey(t *testing.T) {
+	t.Run("key", dbtesting.Inject(func(t *dbtesting.T) {
+		if tx, _ := t.Ctx.Value(txKey{}).(*sql.Tx); tx != t.Tx {
+			t.Fatalf("expected the test's transaction in its context but got %v", tx)
+		}
+	}))
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	var holding int32
+	for i := 0; i < 3; i++ {
+		t.Run("lock", func(t *testing.T) {
+			t.Parallel()
+			dbtesting.Inject(func(t *dbtesting.T) {
+				t.AdvisoryLock(76)
+				if n := atomic.AddInt32(&holding, 1); n != 1 {
+					t.Errorf("expected the lock to be held by one test but it's held by %d", n)
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&holding, -1)
+			})(t)
+		})
+	}
+}
+
+func TestTxCleanup(t *testing.T) {
+	var order []string
+	t.Run("order", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		t.Cleanup(func() {
+			order = append(order, "Cleanup")
+			if _, err := t.Tx.ExecContext(context.Background(), `SELECT 1;`); !errors.Is(err, sql.ErrTxDone) {
+				t.Errorf("expected the transaction to be done in t.Cleanup but got %v", err)
+			}
+		})
+		t.TxCleanup(func() error {
+			order = append(order, "TxCleanup 1")
+			return nil
+		})
+		t.TxCleanup(func() error {
+			order = append(order, "TxCleanup 2")
+			t.AssertCount(`SELECT count(*) FROM films;`, 1)
+			return nil
+		})
+	}))
+
+	if order == nil {
+		return // skipped
+	}
+	if want := []string{"TxCleanup 2", "TxCleanup 1", "Cleanup"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("expected cleanups to run in order %v but got %v", want, order)
+	}
+}
+
+func TestRunTx(t *testing.T) {
+	t.Run("siblings", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'shared', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		for _, code := range []string{"fghij", "klmno"} {
+			code := code
+			t.RunTx(code, func(t *dbtesting.T) {
+				if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ($1, 'sub', 2);`, code); err != nil {
+					t.Fatalf("error inserting: %v", err)
+				}
+				t.AssertCount(`SELECT count(*) FROM films;`, 2)
+			})
+		}
+
+		t.AssertCount(`SELECT count(*) FROM films;`, 1)
+	}))
+}
+
+func TestReset(t *testing.T) {
+	t.Run("cases", dbtesting.InjectWith(dbtesting.TestConfig{
+		SetUp: func(t *dbtesting.T) error {
+			_, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'set up', 1);`)
+			return err
+		},
+		Resettable: true,
+	}, func(t *dbtesting.T) {
+		for _, code := range []string{"fghij", "klmno"} {
+			t.Reset()
+			if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ($1, 'case', 2);`, code); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+			t.AssertCount(`SELECT count(*) FROM films;`, 2)
+		}
+
+		t.RunTx("sub", func(t *dbtesting.T) {
+			if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('pqrst', 'sub', 3);`); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+			t.Reset()
+			t.AssertCount(`SELECT count(*) FROM films;`, 2)
+		})
+		t.AssertCount(`SELECT count(*) FROM films;`, 2)
+	}))
+}
+
+func TestRequireVersion(t *testing.T) {
+	dbtesting.SkipUnlessDB(t)
+	var ran []string
+	for _, c := range []string{">= 9", "< 9", "= 1"} {
+		c := c
+		t.Run(c, dbtesting.Inject(func(t *dbtesting.T) {
+			t.RequireVersion(c)
+			ran = append(ran, c)
+		}))
+	}
+	t.Run("jsonb", dbtesting.Inject(func(t *dbtesting.T) {
+		t.RequireFeature("jsonb")
+		ran = append(ran, "jsonb")
+	}))
+
+	if expected := []string{">= 9", "jsonb"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("expected only %v to run but ran %v", expected, ran)
+	}
+}
+
+func TestAutonomous(t *testing.T) {
+	t.Run("autonomous", dbtesting.Inject(func(t *dbtesting.T) {
+		t.Autonomous(func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'autonomous', 1);`)
+			return err
+		}, func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, `DELETE FROM films WHERE code = 'abcde';`)
+			return err
+		})
+
+		// committed, so visible outside of the test's transaction
+		t.Eventually(`SELECT count(*) FROM films WHERE title = 'autonomous';`, 1, time.Second)
+	}))
+	t.Run("undone", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		var n int
+		if err := t.DB.QueryRowContext(t.Ctx, `SELECT count(*) FROM films;`).Scan(&n); err != nil {
+			t.Fatalf("error counting: %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("expected the autonomous insert to have been undone but found %d films", n)
+		}
+	}))
+}
+
+func TestDriver(t *testing.T) {
+	t.Run("postgres", dbtesting.Inject(func(t *dbtesting.T) {
+		if d := t.Driver(); d != "postgres" {
+			t.Fatalf("expected driver postgres but got %q", d)
+		}
+	}))
+}
+
+func TestBeginTest(t *testing.T) {
+	t.Run("begin", func(t *testing.T) {
+		tt, done, err := dbtesting.BeginTest(t)
+		if err != nil {
+			t.Fatalf("BeginTest: %v", err)
+		}
+		defer done()
+
+		if _, err := tt.Tx.ExecContext(tt.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+		tt.AssertCount(`SELECT count(*) FROM films;`, 1)
+	})
+	t.Run("rolled back", dbtesting.Inject(func(t *dbtesting.T) {
+		t.AssertCount(`SELECT count(*) FROM films;`, 0)
+	}))
+}
+
+func TestResetSequence(t *testing.T) {
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, dbtesting.Inject(func(t *dbtesting.T) {
+			if _, err := t.Tx.ExecContext(t.Ctx, `CREATE SEQUENCE IF NOT EXISTS films_seq;`); err != nil {
+				t.Fatalf("error creating sequence: %v", err)
+			}
+			t.ResetSequence("films_seq", 5)
+
+			var n int64
+			if err := t.Tx.QueryRowContext(t.Ctx, `SELECT nextval('films_seq');`).Scan(&n); err != nil {
+				t.Fatalf("error querying: %v", err)
+			}
+			if n != 5 {
+				t.Fatalf("expected the sequence to restart at 5 but got %d", n)
+			}
+		}))
+	}
+}
+
+func TestInjectCtx(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "trace")
+
+	t.Run("value", dbtesting.InjectCtx(ctx, func(t *dbtesting.T) {
+		if v := t.Ctx.Value(key{}); v != "trace" {
+			t.Fatalf("expected the test's context to carry the caller's value but got %v", v)
+		}
+		if _, ok := t.Ctx.Deadline(); !ok {
+			t.Fatal("expected the test's context to have the configured timeout")
+		}
+	}))
+}
@@ -0,0 +1,92 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	dialectPostgres = "postgres"
+	dialectMySQL    = "mysql"
+	dialectSQLite   = "sqlite"
+)
+
+// detectDialect guesses the SQL dialect from the package implementing the driver, since *sql.DB doesn't expose the name
+// it was opened with.
+func detectDialect(d driver.Driver) string {
+	typ := reflect.TypeOf(d)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch path := typ.PkgPath(); {
+	case strings.Contains(path, "lib/pq"), strings.Contains(path, "pgx"):
+		return dialectPostgres
+	case strings.Contains(path, "mysql"):
+		return dialectMySQL
+	case strings.Contains(path, "sqlite"):
+		return dialectSQLite
+	}
+	return ""
+}
+
+// Dialect returns the SQL dialect of db as described by Config.Driver, i.e. postgres, mysql or sqlite, or else "" if
+// it's unrecognized, for adapting other packages to db.
+func Dialect(db *sql.DB) string {
+	return dialectOf(db)
+}
+
+// dialectOf prefers Config.Driver for the primary database.
+func dialectOf(db *sql.DB) string {
+	if db == state.DB && state.Driver != "" {
+		return state.Driver
+	}
+	return detectDialect(db.Driver())
+}
+
+func placeholder(dialect string, i int) string {
+	if dialect == dialectPostgres {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+func listTables(ctx context.Context, db *sql.DB, dialect string) ([]string, error) {
+	var query string
+	switch dialect {
+	case dialectPostgres:
+		query = `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'`
+	case dialectMySQL:
+		query = `SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'`
+	case dialectSQLite:
+		query = `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`
+	default:
+		return nil, fmt.Errorf("listing tables is unsupported for driver %T", db.Driver())
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func truncateStatement(dialect, table string) string {
+	if dialect == dialectSQLite {
+		return "DELETE FROM " + table
+	}
+	return "TRUNCATE TABLE " + table
+}
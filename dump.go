@@ -0,0 +1,32 @@
+package dbtesting
+
+// Dump logs the contents of table as seen by the test's transaction.
+func (t *T) Dump(table string) {
+	t.Helper()
+
+	if err := t.dump(table); err != nil {
+		t.Fatalf("Dump: %v: %v", table, err)
+	}
+}
+
+func (t *T) dump(table string) error {
+	results, err := t.formatResults("SELECT * FROM " + table)
+	if err != nil {
+		return err
+	}
+	t.Logf("%v:\n%v", table, results)
+	return nil
+}
+
+// dumpOnFailure logs Config.DumpTablesOnFailure if the test has failed; errors are only logged so that every table
+// is tried.
+func (t *T) dumpOnFailure() {
+	if !t.Failed() {
+		return
+	}
+	for _, table := range t.state.DumpTablesOnFailure {
+		if err := t.dump(table); err != nil {
+			t.Logf("dumping %v: %v", table, err)
+		}
+	}
+}
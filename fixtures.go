@@ -0,0 +1,179 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fixture is a set of rows to insert into Table, where each row maps column names to values.
+type Fixture struct {
+	Table string                   `json:"table"`
+	Rows  []map[string]interface{} `json:"rows"`
+	// Upsert skips rows which conflict with those already in Table, so that fixtures can be loaded again, e.g. after a
+	// reset which keeps some tables. It's supported on Postgres, MySQL and SQLite.
+	Upsert bool `json:"upsert"`
+	// ConflictColumns are the unique columns whose conflicts Upsert skips on Postgres and SQLite, defaulting to any
+	// unique constraint, like the primary key. MySQL always skips conflicts on any of them.
+	ConflictColumns []string `json:"conflict_columns"`
+}
+
+// Fixtures inserts the rows of each fixture in order.
+func Fixtures(fixtures ...Fixture) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		return loadFixtures(ctx, db, fixtures)
+	}
+}
+
+// FixtureGroups inserts each group of fixtures in order, loading the fixtures within a group concurrently with up to
+// workers at a time, each on its own connection from the pool. A group's fixtures must therefore be independent, e.g.
+// of different tables without foreign keys between them, while they can depend on those of earlier groups. The first
+// failure stops the rest of the group and is returned.
+func FixtureGroups(workers int, groups ...[]Fixture) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for _, group := range groups {
+			if err := loadConcurrently(ctx, db, workers, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func loadConcurrently(ctx context.Context, db *sql.DB, workers int, fixtures []Fixture) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cncl := context.WithCancel(ctx)
+	defer cncl()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+		sem   = make(chan struct{}, workers)
+	)
+loop:
+	for _, fix := range fixtures {
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+
+		fix := fix
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := loadFixtures(ctx, db, []Fixture{fix}); err != nil {
+				once.Do(func() {
+					first = err
+					cncl()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	// only the parent context can have been cancelled
+	return ctx.Err()
+}
+
+// FixturesFS reads fixtures from a JSON file in fsys, e.g. an embed.FS. The file should contain an array of objects with
+// "table" and "rows" keys, which are loaded in order.
+func FixturesFS(fsys fs.FS, name string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		fixtures, err := readFixtures(fsys, name)
+		if err != nil {
+			return err
+		}
+		return loadFixtures(ctx, db, fixtures)
+	}
+}
+
+func readFixtures(fsys fs.FS, name string) ([]Fixture, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", name, err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+
+	var fixtures []Fixture
+	if err := dec.Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", name, err)
+	}
+	return fixtures, nil
+}
+
+func loadFixtures(ctx context.Context, db *sql.DB, fixtures []Fixture) error {
+	dialect := dialectOf(db)
+	for _, fix := range fixtures {
+		for i, row := range fix.Rows {
+			query, args, err := insertQuery(dialect, fix, row)
+			if err != nil {
+				return fmt.Errorf("table %v: %w", fix.Table, err)
+			}
+			if _, err := db.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("table %v row %d: %w", fix.Table, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func insertQuery(dialect string, fix Fixture, row map[string]interface{}) (string, []interface{}, error) {
+	cols := sortedColumns(row)
+	params := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, c := range cols {
+		params[i] = placeholder(dialect, i+1)
+		args[i] = row[c]
+	}
+
+	insert, conflict := "INSERT", ""
+	if fix.Upsert {
+		switch dialect {
+		case dialectPostgres, dialectSQLite:
+			conflict = " ON CONFLICT DO NOTHING"
+			if len(fix.ConflictColumns) > 0 {
+				conflict = fmt.Sprintf(" ON CONFLICT (%v) DO NOTHING", strings.Join(fix.ConflictColumns, ", "))
+			}
+		case dialectMySQL:
+			insert = "INSERT IGNORE"
+		default:
+			return "", nil, fmt.Errorf("Upsert is unsupported for driver %q", dialect)
+		}
+	}
+
+	return fmt.Sprintf(
+		"%v INTO %v (%v) VALUES (%v)%v",
+		insert,
+		fix.Table,
+		strings.Join(cols, ", "),
+		strings.Join(params, ", "),
+		conflict,
+	), args, nil
+}
+
+func sortedColumns(row map[string]interface{}) []string {
+	cols := make([]string, 0, len(row))
+	for c := range row {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	return cols
+}
@@ -0,0 +1,65 @@
+package dbtesting_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestFixturesFSInvalid(t *testing.T) {
+	fsys := fstest.MapFS{"fixtures.json": {Data: []byte(`{"table": "films"}`)}}
+
+	err := dbtesting.FixturesFS(fsys, "fixtures.json")(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "decoding fixtures.json") {
+		t.Fatalf("expected a decoding error naming the file but got %v", err)
+	}
+}
+
+func TestCopyRows(t *testing.T) {
+	t.Run("copy", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		rows := make([][]interface{}, 250)
+		for i := range rows {
+			rows[i] = []interface{}{fmt.Sprintf("c%04d", i), "copied", i}
+		}
+		if err := dbtesting.CopyRows("films", []string{"code", "title", "did"}, rows)(t.Ctx, t.DB); err != nil {
+			t.Fatalf("CopyRows: %v", err)
+		}
+
+		var n int
+		if err := t.DB.QueryRowContext(t.Ctx, `SELECT count(*) FROM films WHERE title = 'copied';`).Scan(&n); err != nil {
+			t.Fatalf("error counting: %v", err)
+		}
+		if n != 250 {
+			t.Fatalf("expected 250 copied films but found %d", n)
+		}
+	}))
+}
+
+func TestFixtureGroups(t *testing.T) {
+	t.Run("groups", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		var group []dbtesting.Fixture
+		for i := 0; i < 10; i++ {
+			group = append(group, dbtesting.Fixture{Table: "films", Rows: []map[string]interface{}{
+				{"code": fmt.Sprintf("c%04d", i), "title": "grouped", "did": i},
+			}})
+		}
+		failing := []dbtesting.Fixture{{Table: "films", Rows: []map[string]interface{}{{"code": "c0000", "title": "duplicate", "did": 0}}}}
+
+		err := dbtesting.FixtureGroups(4, group, failing, group)(t.Ctx, t.DB)
+		if err == nil || !strings.Contains(err.Error(), "table films row 0") {
+			t.Fatalf("expected the duplicate to fail but got %v", err)
+		}
+
+		var n int
+		if err := t.DB.QueryRowContext(t.Ctx, `SELECT count(*) FROM films WHERE title = 'grouped';`).Scan(&n); err != nil {
+			t.Fatalf("error counting: %v", err)
+		}
+		if n != 10 {
+			t.Fatalf("expected the 10 films of the first group but found %d", n)
+		}
+	}))
+}
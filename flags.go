@@ -0,0 +1,20 @@
+package dbtesting
+
+import "flag"
+
+// Flags holds this package's flags, which are also registered on flag.CommandLine, e.g. to be passed with
+// go test -args -dbtesting.dsn=postgres://localhost/test.
+var Flags = flag.NewFlagSet("dbtesting", flag.ContinueOnError)
+
+var (
+	dsnFlag     = Flags.String("dbtesting.dsn", "", "the DRIVER:DSN_INFORMATION to connect to, overriding "+dsnEnvVar)
+	updateFlag  = Flags.Bool("dbtesting.update", false, "rewrite golden files with the results of T.Golden")
+	commitFlag  = Flags.Bool("dbtesting.commit", false, "commit the transactions of passing tests, like "+commitEnvVar+"=1")
+	verboseFlag = Flags.Bool("dbtesting.verbose", false, "log the statements executed by SQL, SQLStatements, SQLFile and SQLFS")
+)
+
+func init() {
+	Flags.VisitAll(func(f *flag.Flag) {
+		flag.CommandLine.Var(f.Value, f.Name, f.Usage)
+	})
+}
@@ -0,0 +1,141 @@
+package dbtesting
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Golden compares the results of query, including its column names, against testdata/<name>.golden, failing with a
+// diff if they differ. Running with -dbtesting.update rewrites the file instead. The query should order its rows for
+// the comparison to be deterministic.
+func (t *T) Golden(name string, query string, args ...interface{}) {
+	t.Helper()
+
+	got, err := t.formatResults(query, args...)
+	if err != nil {
+		t.Fatalf("Golden: %q with args %v: %v", query, args, err)
+	}
+
+	path := filepath.Join("testdata", name+".golden")
+	if *updateFlag {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Golden: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("Golden: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Golden: %v; run with -dbtesting.update to create it", err)
+	}
+	if string(want) != got {
+		t.Fatalf("Golden: results of %q differ from %v:\n%v", query, path, diffLines(string(want), got))
+	}
+}
+
+// formatResults renders a header of column names followed by each row, with tab separated values.
+func (t *T) formatResults(query string, args ...interface{}) (string, error) {
+	cols, rows, err := t.resultLines(query, args...)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.Join(cols, "\t") + "\n")
+	for _, r := range rows {
+		b.WriteString(r + "\n")
+	}
+	return b.String(), nil
+}
+
+// resultLines returns the column names of query's results and each of its rows with tab separated values, formatted
+// so that values scanned as different types, like int64 and []byte, compare as equal.
+func (t *T) resultLines(query string, args ...interface{}) ([]string, []string, error) {
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	rows, err := t.Tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lines []string
+	values := make([]interface{}, len(cols))
+	targets := make([]interface{}, len(cols))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return nil, nil, err
+		}
+		formatted := make([]string, len(values))
+		for i, v := range values {
+			formatted[i] = formatValue(v)
+		}
+		lines = append(lines, strings.Join(formatted, "\t"))
+	}
+	return cols, lines, rows.Err()
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// diffLines describes the lines removed from want and added in got, finding the longest common subsequence.
+func diffLines(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var d strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			d.WriteString("  " + a[i] + "\n")
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			d.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			d.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return d.String()
+}
@@ -0,0 +1,35 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// Harness runs tests in transactions on a database the caller has opened, independently of RunTests and the
+// package-wide configuration, e.g. where TestMain is out of reach.
+type Harness struct {
+	s settings
+}
+
+// New returns a Harness running tests on db, with the default timeouts and transaction options. The database isn't
+// set up, cleaned up or closed, and tests aren't skipped in short mode.
+func New(db *sql.DB) *Harness {
+	h := &Harness{s: settings{DB: db, Initialized: true}}
+	h.s.Driver = detectDialect(db.Driver())
+	h.s.TestTimeout, h.s.CleanUpTimeout = DefaultTestTimeout, DefaultCleanUpTimeout
+	h.s.Strategy = StrategyTransaction
+
+	ctx, cncl := context.WithTimeout(context.Background(), DefaultSetUpTimeout)
+	defer cncl()
+	h.s.probeVersion(ctx)
+	return h
+}
+
+// Inject is like the package's Inject, running f in a transaction on the Harness's database which is rolled back
+// afterwards.
+func (h *Harness) Inject(f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		inject(context.Background(), &h.s, t, TestConfig{}, f)
+	}
+}
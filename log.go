@@ -0,0 +1,19 @@
+package dbtesting
+
+type printfLogger interface {
+	Printf(format string, v ...interface{})
+}
+
+// fieldLogger is implemented by loggers which record events with fields, like SlogLogger.
+type fieldLogger interface {
+	logFields(msg string, fields []interface{})
+}
+
+// logEvent logs msg with fields, alternating keys and values, when l records them, and as format otherwise.
+func logEvent(l printfLogger, msg string, fields []interface{}, format string, args ...interface{}) {
+	if fl, ok := l.(fieldLogger); ok {
+		fl.logFields(msg, fields)
+		return
+	}
+	l.Printf(format, args...)
+}
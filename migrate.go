@@ -0,0 +1,107 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var migrationName = regexp.MustCompile(`^(\d+)_(.*)\.(up|down)\.sql$`)
+
+type migration struct {
+	version  uint64
+	up, down string
+}
+
+// Migrate reads migrations from dir in fsys, named as golang-migrate expects, e.g. 1_create_films.up.sql and
+// 1_create_films.down.sql. The returned set up function applies every up migration in version order, and the clean up
+// function applies the down migrations in reverse.
+func Migrate(fsys fs.FS, dir string) (setUp, cleanUp func(context.Context, *sql.DB) error) {
+	setUp = func(ctx context.Context, db *sql.DB) error {
+		migrations, err := readMigrations(fsys, dir)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.up == "" {
+				continue
+			}
+			if err := execMigration(ctx, fsys, db, m.up); err != nil {
+				return fmt.Errorf("migrating up to version %d: %w", m.version, err)
+			}
+		}
+		return nil
+	}
+
+	cleanUp = func(ctx context.Context, db *sql.DB) error {
+		migrations, err := readMigrations(fsys, dir)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if m.down == "" {
+				continue
+			}
+			if err := execMigration(ctx, fsys, db, m.down); err != nil {
+				return fmt.Errorf("migrating down from version %d: %w", m.version, err)
+			}
+		}
+		return nil
+	}
+
+	return setUp, cleanUp
+}
+
+func readMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", dir, err)
+	}
+
+	byVersion := make(map[uint64]*migration)
+	for _, e := range entries {
+		match := migrationName.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing version of %v: %w", e.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version}
+			byVersion[version] = m
+		}
+		name, target := path.Join(dir, e.Name()), &m.up
+		if match[3] == "down" {
+			target = &m.down
+		}
+		if *target != "" {
+			return nil, fmt.Errorf("duplicate %v migrations for version %d: %v and %v", match[3], version, *target, name)
+		}
+		*target = name
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+func execMigration(ctx context.Context, fsys fs.FS, db *sql.DB, name string) error {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", name, err)
+	}
+	return execFile(ctx, db, name, b)
+}
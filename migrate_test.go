@@ -0,0 +1,25 @@
+package dbtesting_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestMigrateDuplicateVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/1_create_films.up.sql":  {Data: []byte(`CREATE TABLE films ();`)},
+		"migrations/01_create_films.up.sql": {Data: []byte(`CREATE TABLE films ();`)},
+	}
+
+	up, down := dbtesting.Migrate(fsys, "migrations")
+	if err := up(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "duplicate up migrations for version 1") {
+		t.Fatalf("expected a duplicate version error but got %v", err)
+	}
+	if err := down(context.Background(), nil); err == nil {
+		t.Fatal("expected a duplicate version error")
+	}
+}
@@ -0,0 +1,238 @@
+// Package pgxtesting runs each test in a pgx transaction begun from a pgxpool.Pool, which is rolled back afterwards,
+// following the same conventions as dbtesting.
+package pgxtesting
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jwilner/dbtesting"
+)
+
+type T struct {
+	*testing.T
+	Tx  pgx.Tx
+	Ctx context.Context
+}
+
+type Config struct {
+	// DSN is connected to by the default ConnectFunc, and is resolved like dbtesting.Config.DSN; the driver named by
+	// its prefix is ignored.
+	DSN         string
+	DSNEnvVar   string
+	ConnectFunc func(context.Context) (*pgxpool.Pool, error)
+	// Pool is used instead of ConnectFunc when set, and is left open for the caller to close.
+	Pool *pgxpool.Pool
+
+	SkipFunc func() bool
+	// SkipReasonFunc takes precedence over SkipFunc, and its reason is reported by each skipped test.
+	SkipReasonFunc func() (bool, string)
+	SetUpFunc      func(context.Context, *pgxpool.Pool) error
+	CleanUpFunc    func(context.Context, *pgxpool.Pool) error
+
+	SetUpTimeout   time.Duration
+	CleanUpTimeout time.Duration
+	TestTimeout    time.Duration
+
+	TxOptions pgx.TxOptions
+
+	Logger interface {
+		Printf(format string, args ...interface{})
+	}
+	// LogPrefix begins each line of the default Logger, which writes to stderr; it defaults to "pgxtesting: ".
+	LogPrefix string
+}
+
+var state = struct {
+	Skip       bool
+	SkipReason string
+	Pool       *pgxpool.Pool
+	Config
+}{}
+
+func RunTests(m *testing.M, cfg Config) int {
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger(cfg.LogPrefix)
+	}
+	code, err := Run(m, cfg)
+	if err != nil {
+		cfg.Logger.Printf("%v", err)
+	}
+	return code
+}
+
+func Run(m *testing.M, cfg Config) (int, error) {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	return runTests(m, withDefaults(cfg))
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.SetUpTimeout == 0 {
+		cfg.SetUpTimeout = dbtesting.DefaultSetUpTimeout
+	}
+	if cfg.CleanUpTimeout == 0 {
+		cfg.CleanUpTimeout = dbtesting.DefaultCleanUpTimeout
+	}
+	if cfg.TestTimeout == 0 {
+		cfg.TestTimeout = dbtesting.DefaultTestTimeout
+	}
+	if cfg.ConnectFunc == nil {
+		cfg.ConnectFunc = defaultConnect(cfg.DSNEnvVar, cfg.DSN)
+	}
+	if cfg.SkipReasonFunc == nil {
+		skip, reason := cfg.SkipFunc, "skipped by Config.SkipFunc"
+		if skip == nil {
+			skip, reason = testing.Short, "skipping database tests in short mode"
+		}
+		cfg.SkipReasonFunc = func() (bool, string) { return skip(), reason }
+	}
+	if cfg.SetUpFunc == nil {
+		cfg.SetUpFunc = func(context.Context, *pgxpool.Pool) error { return nil }
+	}
+	if cfg.CleanUpFunc == nil {
+		cfg.CleanUpFunc = func(context.Context, *pgxpool.Pool) error { return nil }
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger(cfg.LogPrefix)
+	}
+	return cfg
+}
+
+func runTests(m interface{ Run() int }, cfg Config) (int, error) {
+	if state.Skip, state.SkipReason = cfg.SkipReasonFunc(); state.Skip {
+		return m.Run(), nil
+	}
+
+	ctx, cncl := context.WithTimeout(context.Background(), cfg.SetUpTimeout)
+	defer cncl()
+
+	pool := cfg.Pool
+	if pool == nil {
+		var err error
+		if pool, err = cfg.ConnectFunc(ctx); err != nil {
+			return 1, fmt.Errorf("ConnectFunc: %w", err)
+		}
+		// we only close what we opened
+		defer pool.Close()
+	}
+	if err := pool.Ping(ctx); err != nil {
+		return 1, fmt.Errorf("pool.Ping: %w", err)
+	}
+
+	if err := cfg.SetUpFunc(ctx, pool); err != nil {
+		return 1, fmt.Errorf("SetUpFunc: %w", err)
+	}
+
+	state.Pool = pool
+	state.Config = cfg
+
+	defer func() {
+		ctx, cncl := context.WithTimeout(context.Background(), cfg.CleanUpTimeout)
+		defer cncl()
+		if err := cfg.CleanUpFunc(ctx, pool); err != nil {
+			cfg.Logger.Printf("CleanUpFunc: %v", err)
+		}
+	}()
+
+	return m.Run(), nil
+}
+
+// Inject runs f within a transaction which is rolled back once f completes, whether it passes, fails or panics.
+func Inject(f func(*T)) func(t *testing.T) {
+	return InjectWithOptions(state.TxOptions, f)
+}
+
+func InjectWithOptions(opts pgx.TxOptions, f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		if state.Skip {
+			t.Skip(state.SkipReason)
+		}
+
+		ctx, cncl := context.WithTimeout(context.Background(), state.TestTimeout)
+		defer cncl()
+
+		tx, err := state.Pool.BeginTx(ctx, opts)
+		if err != nil {
+			t.Fatalf("pool.BeginTx: %v", err)
+		}
+		defer func() {
+			// the test's context may have expired, but the rollback should still happen
+			ctx, cncl := context.WithTimeout(context.Background(), state.CleanUpTimeout)
+			defer cncl()
+			if err := tx.Rollback(ctx); err != nil {
+				t.Logf("tx.Rollback: %v", err)
+			}
+		}()
+
+		f(&T{T: t, Tx: tx, Ctx: ctx})
+	}
+}
+
+// ExpectNotify listens on channel on a connection of its own, runs trigger and returns the payload of the first
+// notification on channel, failing the test unless one arrives within timeout. Notifications are only delivered once
+// the transaction sending them commits, so trigger can't send them through t.Tx, which is never committed.
+func (t *T) ExpectNotify(channel string, timeout time.Duration, trigger func()) string {
+	t.Helper()
+
+	conn, err := state.Pool.Acquire(t.Ctx)
+	if err != nil {
+		t.Fatalf("ExpectNotify: pool.Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	ident := pgx.Identifier{channel}.Sanitize()
+	if _, err := conn.Exec(t.Ctx, "LISTEN "+ident); err != nil {
+		t.Fatalf("ExpectNotify: LISTEN %v: %v", ident, err)
+	}
+	defer func() {
+		// the connection goes back to the pool, which mustn't be left listening
+		ctx, cncl := context.WithTimeout(context.Background(), state.CleanUpTimeout)
+		defer cncl()
+		if _, err := conn.Exec(ctx, "UNLISTEN "+ident); err != nil {
+			t.Logf("ExpectNotify: UNLISTEN %v: %v", ident, err)
+		}
+	}()
+
+	trigger()
+
+	ctx, cncl := context.WithTimeout(t.Ctx, timeout)
+	defer cncl()
+	n, err := conn.Conn().WaitForNotification(ctx)
+	if err != nil {
+		t.Fatalf("ExpectNotify: no notification on %v within %v: %v", channel, timeout, err)
+	}
+	return n.Payload
+}
+
+// SQL returns a SetUpFunc or CleanUpFunc which executes query, which may hold several statements.
+func SQL(query string) func(context.Context, *pgxpool.Pool) error {
+	return func(ctx context.Context, pool *pgxpool.Pool) error {
+		_, err := pool.Exec(ctx, query)
+		return err
+	}
+}
+
+func defaultConnect(envVar, configured string) func(context.Context) (*pgxpool.Pool, error) {
+	return func(ctx context.Context) (*pgxpool.Pool, error) {
+		_, source, err := dbtesting.ResolveDSN(envVar, configured)
+		if err != nil {
+			return nil, err
+		}
+		return pgxpool.New(ctx, source)
+	}
+}
+
+func defaultLogger(prefix string) *log.Logger {
+	if prefix == "" {
+		prefix = "pgxtesting: "
+	}
+	return dbtesting.DefaultLogger(prefix)
+}
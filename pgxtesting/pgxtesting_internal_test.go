@@ -0,0 +1,42 @@
+package pgxtesting
+
+import (
+	"log"
+	"testing"
+)
+
+type runFunc func() int
+
+func (f runFunc) Run() int {
+	return f()
+}
+
+func TestSkipReason(t *testing.T) {
+	saved := state
+	defer func() {
+		state = saved
+	}()
+
+	cfg := withDefaults(Config{SkipReasonFunc: func() (bool, string) { return true, "no database today" }})
+	code, err := runTests(runFunc(func() int {
+		t.Run("skipped", Inject(func(t *T) {
+			t.Fatal("expected the test to be skipped")
+		}))
+		return 0
+	}), cfg)
+	if code != 0 || err != nil {
+		t.Fatalf("expected to run the skipped tests but got %d, %v", code, err)
+	}
+	if state.SkipReason != "no database today" {
+		t.Fatalf("expected the skip reason to be recorded but got %q", state.SkipReason)
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	if p := withDefaults(Config{}).Logger.(*log.Logger).Prefix(); p != "pgxtesting: " {
+		t.Fatalf("expected the default prefix to be separated from the timestamp but got %q", p)
+	}
+	if p := withDefaults(Config{LogPrefix: "pgx| "}).Logger.(*log.Logger).Prefix(); p != "pgx| " {
+		t.Fatalf("expected Config.LogPrefix but got %q", p)
+	}
+}
@@ -0,0 +1,63 @@
+package pgxtesting_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jwilner/dbtesting"
+	"github.com/jwilner/dbtesting/pgxtesting"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(pgxtesting.RunTests(m, pgxtesting.Config{
+		SetUpFunc: pgxtesting.SQL(`
+CREATE TABLE pgx_films (
+    code        char(5) PRIMARY KEY,
+    title       varchar(40) NOT NULL
+);
+`),
+		CleanUpFunc: pgxtesting.SQL(`DROP TABLE pgx_films;`),
+	}))
+}
+
+func TestInject(t *testing.T) {
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, pgxtesting.Inject(func(t *pgxtesting.T) {
+			if _, err := t.Tx.Exec(t.Ctx, `INSERT INTO pgx_films (code, title) VALUES ('abcde', $1);`, name); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+
+			var n int
+			if err := t.Tx.QueryRow(t.Ctx, `SELECT count(*) FROM pgx_films;`).Scan(&n); err != nil {
+				t.Fatalf("error counting: %v", err)
+			}
+			if n != 1 {
+				t.Fatalf("expected 1 film but found %d", n)
+			}
+		}))
+	}
+}
+
+func TestExpectNotify(t *testing.T) {
+	t.Run("notify", pgxtesting.Inject(func(t *pgxtesting.T) {
+		payload := t.ExpectNotify("films changed", time.Second, func() {
+			_, source, err := dbtesting.ResolveDSN("", "")
+			if err != nil {
+				t.Fatalf("ResolveDSN: %v", err)
+			}
+			conn, err := pgx.Connect(t.Ctx, source)
+			if err != nil {
+				t.Fatalf("pgx.Connect: %v", err)
+			}
+			defer conn.Close(t.Ctx)
+			if _, err := conn.Exec(t.Ctx, `SELECT pg_notify('films changed', 'abcde');`); err != nil {
+				t.Fatalf("error notifying: %v", err)
+			}
+		})
+		if payload != "abcde" {
+			t.Fatalf("expected abcde but got %q", payload)
+		}
+	}))
+}
@@ -0,0 +1,166 @@
+package dbtesting
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// MustQueryRow scans the first row returned by query into dest, failing the test on any error, including when there are
+// no rows.
+func (t *T) MustQueryRow(dest []interface{}, query string, args ...interface{}) {
+	t.Helper()
+
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	if err := t.Tx.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
+		t.Fatalf("MustQueryRow: %q with args %v: %v", query, args, err)
+	}
+}
+
+// QueryOne scans the single row returned by query into dest, failing the test unless exactly one row is returned.
+func (t *T) QueryOne(dest []interface{}, query string, args ...interface{}) {
+	t.Helper()
+
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	rows, err := t.Tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		t.Fatalf("QueryOne: %q with args %v: %v", query, args, err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for ; rows.Next(); n++ {
+		if n > 0 {
+			// keep counting to report how many there were
+			continue
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatalf("QueryOne: %q with args %v: %v", query, args, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("QueryOne: %q with args %v: %v", query, args, err)
+	}
+	if n != 1 {
+		t.Fatalf("QueryOne: %q with args %v returned %d rows, expected 1", query, args, n)
+	}
+}
+
+// InsertReturning inserts a row of values into table, failing the test on any error, and returns the generated value of
+// the returning column, e.g. id := t.InsertReturning("films", map[string]interface{}{"title": "first"}, "id"). On MySQL,
+// which has no RETURNING clause, it instead returns the result's LastInsertId, whatever returning names.
+func (t *T) InsertReturning(table string, values map[string]interface{}, returning string) interface{} {
+	t.Helper()
+
+	query, args, err := insertQuery(t.Driver(), Fixture{Table: table}, values)
+	if err != nil {
+		t.Fatalf("InsertReturning: %v: %v", table, err)
+	}
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+
+	if t.Driver() == dialectMySQL {
+		res, err := t.Tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			t.Fatalf("InsertReturning: %q with args %v: %v", query, args, err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			t.Fatalf("InsertReturning: %q with args %v: %v", query, args, err)
+		}
+		return id
+	}
+
+	query += " RETURNING " + returning
+	var key interface{}
+	if err := t.Tx.QueryRowContext(ctx, query, args...).Scan(&key); err != nil {
+		t.Fatalf("InsertReturning: %q with args %v: %v", query, args, err)
+	}
+	return key
+}
+
+// QueryStructs scans the rows returned by query into dest, which must be a pointer to a slice of structs or of pointers
+// to structs. Columns are matched to fields by their `db` tag, or else by case-insensitive name.
+func (t *T) QueryStructs(dest interface{}, query string, args ...interface{}) {
+	t.Helper()
+
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		t.Fatalf("QueryStructs: expected a pointer to a slice but got %T", dest)
+	}
+	slice = slice.Elem()
+
+	elem := slice.Type().Elem()
+	isPtr := elem.Kind() == reflect.Ptr
+	if isPtr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		t.Fatalf("QueryStructs: expected a slice of structs but got %T", dest)
+	}
+
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+	rows, err := t.Tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		t.Fatalf("QueryStructs: %q with args %v: %v", query, args, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("QueryStructs: rows.Columns: %v", err)
+	}
+	fields, err := fieldIndexes(elem, cols)
+	if err != nil {
+		t.Fatalf("QueryStructs: %v", err)
+	}
+
+	for rows.Next() {
+		v := reflect.New(elem).Elem()
+		targets := make([]interface{}, len(fields))
+		for i, idx := range fields {
+			targets[i] = v.FieldByIndex(idx).Addr().Interface()
+		}
+		if err := rows.Scan(targets...); err != nil {
+			t.Fatalf("QueryStructs: rows.Scan: %v", err)
+		}
+		if isPtr {
+			v = v.Addr()
+		}
+		slice.Set(reflect.Append(slice, v))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("QueryStructs: rows.Err: %v", err)
+	}
+}
+
+func fieldIndexes(typ reflect.Type, cols []string) ([][]int, error) {
+	byName := make(map[string][]int)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		if tag, ok := f.Tag.Lookup("db"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = strings.ToLower(tag)
+		}
+		byName[name] = f.Index
+	}
+
+	fields := make([][]int, len(cols))
+	for i, c := range cols {
+		idx, ok := byName[strings.ToLower(c)]
+		if !ok {
+			return nil, fmt.Errorf("no field of %v for column %q", typ, c)
+		}
+		fields[i] = idx
+	}
+	return fields, nil
+}
@@ -0,0 +1,76 @@
+package dbtesting_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestQueryStructs(t *testing.T) {
+	type film struct {
+		Code  string
+		Name  string `db:"title"`
+		Did   int
+		Extra string `db:"-"`
+	}
+
+	t.Run("scan", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1), ('fghij', 'second', 2);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		var films []film
+		t.QueryStructs(&films, `SELECT code, title, did FROM films ORDER BY code;`)
+		if expected := []film{{"abcde", "first", 1, ""}, {"fghij", "second", 2, ""}}; !reflect.DeepEqual(films, expected) {
+			t.Fatalf("expected %v but got %v", expected, films)
+		}
+
+		var ptrs []*film
+		t.QueryStructs(&ptrs, `SELECT code AS "CODE", title FROM films WHERE did = $1;`, 2)
+		if len(ptrs) != 1 || *ptrs[0] != (film{Code: "fghij", Name: "second"}) {
+			t.Fatalf("unexpected films: %v", ptrs)
+		}
+	}))
+}
+
+func TestMustQueryRow(t *testing.T) {
+	t.Run("scan", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'title', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		var (
+			title string
+			did   int
+		)
+		t.MustQueryRow([]interface{}{&title, &did}, `SELECT title, did FROM films WHERE code = $1;`, "abcde")
+		if title != "title" || did != 1 {
+			t.Fatalf("unexpected row: %v, %v", title, did)
+		}
+	}))
+}
+
+func TestInsertReturning(t *testing.T) {
+	t.Run("insert", dbtesting.Inject(func(t *dbtesting.T) {
+		did := t.InsertReturning("films", map[string]interface{}{"code": "abcde", "title": "first", "did": 7}, "did")
+		if did != int64(7) {
+			t.Fatalf("expected 7 but got %#v", did)
+		}
+		t.AssertOneRow("films", map[string]interface{}{"code": "abcde", "did": 7})
+	}))
+}
+
+func TestQueryOne(t *testing.T) {
+	t.Run("scan", dbtesting.Inject(func(t *dbtesting.T) {
+		if _, err := t.Tx.ExecContext(t.Ctx, `INSERT INTO films (code, title, did) VALUES ('abcde', 'first', 1), ('fghij', 'second', 1);`); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		var title string
+		t.QueryOne([]interface{}{&title}, `SELECT title FROM films WHERE code = $1;`, "fghij")
+		if title != "second" {
+			t.Fatalf("expected second but got %q", title)
+		}
+	}))
+}
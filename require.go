@@ -0,0 +1,174 @@
+package dbtesting
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// features are those RequireFeature knows of, by the version of each driver which first supports them; drivers
+// missing from a feature's map don't support it at all.
+var features = map[string]map[string][]int{
+	"jsonb":             {dialectPostgres: {9, 4}},
+	"json":              {dialectPostgres: {9, 2}, dialectMySQL: {5, 7}, dialectSQLite: {3, 38}},
+	"procedures":        {dialectPostgres: {11}, dialectMySQL: {5}},
+	"returning":         {dialectPostgres: {8, 2}, dialectSQLite: {3, 35}},
+	"upsert":            {dialectPostgres: {9, 5}, dialectMySQL: {4, 1}, dialectSQLite: {3, 24}},
+	"cte":               {dialectPostgres: {8, 4}, dialectMySQL: {8}, dialectSQLite: {3, 8, 3}},
+	"window functions":  {dialectPostgres: {8, 4}, dialectMySQL: {8}, dialectSQLite: {3, 25}},
+	"generated columns": {dialectPostgres: {12}, dialectMySQL: {5, 7}, dialectSQLite: {3, 31}},
+}
+
+// RequireVersion skips the test unless the database's server version satisfies constraint, a version optionally
+// preceded by one of >=, >, <=, < or =, e.g. ">= 14" or "< 8.0.30". Only as many parts of the version are compared as
+// constraint gives, so "= 14" is satisfied by 14.2. The version is read once, when the database is set up.
+func (t *T) RequireVersion(constraint string) {
+	t.Helper()
+
+	op, want, err := parseConstraint(constraint)
+	if err != nil {
+		t.Fatalf("RequireVersion: %v", err)
+	}
+	if t.state.VersionErr != nil {
+		t.Fatalf("RequireVersion: %v", t.state.VersionErr)
+	}
+	got := t.state.VersionParts
+	if len(got) > len(want) {
+		got = got[:len(want)]
+	}
+	c := compareVersions(got, want)
+	var ok bool
+	switch op {
+	case ">=":
+		ok = c >= 0
+	case ">":
+		ok = c > 0
+	case "<=":
+		ok = c <= 0
+	case "<":
+		ok = c < 0
+	default:
+		ok = c == 0
+	}
+	if !ok {
+		t.Skipf("requires %v %v, but connected to %v", t.Driver(), constraint, t.state.Version)
+	}
+}
+
+// RequireFeature skips the test unless the database supports feature, judged by its driver and server version: one of
+// jsonb, json, procedures, returning, upsert, cte, window functions or generated columns.
+func (t *T) RequireFeature(feature string) {
+	t.Helper()
+
+	since, ok := features[feature]
+	if !ok {
+		names := make([]string, 0, len(features))
+		for name := range features {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Fatalf("RequireFeature: unknown feature %q; expected one of %v", feature, strings.Join(names, ", "))
+	}
+	if t.state.VersionErr != nil {
+		t.Fatalf("RequireFeature: %v", t.state.VersionErr)
+	}
+	min, ok := since[t.Driver()]
+	if !ok {
+		t.Skipf("requires %v, which %v doesn't support", feature, t.Driver())
+	}
+	if compareVersions(t.state.VersionParts, min) < 0 {
+		t.Skipf("requires %v, which %v supports from %v, but connected to %v", feature, t.Driver(), formatVersion(min), t.state.Version)
+	}
+}
+
+// probeVersion reads the server version of s.DB for RequireVersion and RequireFeature, recording rather than
+// returning any error, since it only matters to tests using them.
+func (s *settings) probeVersion(ctx context.Context) {
+	var query string
+	switch s.Driver {
+	case dialectPostgres:
+		query = "SHOW server_version"
+	case dialectMySQL:
+		query = "SELECT version()"
+	case dialectSQLite:
+		query = "SELECT sqlite_version()"
+	default:
+		s.VersionErr = fmt.Errorf("can't read the server version for driver %q", s.Driver)
+		return
+	}
+
+	if err := s.DB.QueryRowContext(ctx, query).Scan(&s.Version); err != nil {
+		s.VersionErr = fmt.Errorf("reading the server version: %v: %w", query, err)
+		return
+	}
+	if s.VersionParts = parseVersion(s.Version); len(s.VersionParts) == 0 {
+		s.VersionErr = fmt.Errorf("unrecognized server version %q", s.Version)
+	}
+}
+
+// parseVersion parses the leading dotted numbers of a version, e.g. 8.0.33 from "8.0.33-0ubuntu0.22.04.2" or 16.2
+// from "16.2 (Debian 16.2-1.pgdg120+2)".
+func parseVersion(v string) []int {
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		end := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' })
+		if end == -1 {
+			end = len(p)
+		}
+		n, err := strconv.Atoi(p[:end])
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+		if end < len(p) {
+			break
+		}
+	}
+	return parts
+}
+
+func parseConstraint(constraint string) (string, []int, error) {
+	v := strings.TrimSpace(constraint)
+	op := "="
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(v, o) {
+			op, v = o, strings.TrimSpace(v[len(o):])
+			break
+		}
+	}
+	parts := parseVersion(v)
+	if len(parts) == 0 || formatVersion(parts) != v {
+		return "", nil, fmt.Errorf("invalid version constraint %q", constraint)
+	}
+	return op, parts, nil
+}
+
+// compareVersions compares versions part by part, treating missing parts as zero.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(parts []int) string {
+	s := make([]string, len(parts))
+	for i, p := range parts {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ".")
+}
@@ -0,0 +1,153 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TDB is handed to tests run with InjectDB.
+type TDB struct {
+	*testing.T
+	DB  *sql.DB
+	Ctx context.Context
+
+	queriesBefore int64
+}
+
+// InjectDB runs f against the database itself rather than a transaction, for code under test which manages its own
+// transactions. Afterwards, whether f passes, fails or panics, the database is reset with Config.ResetFunc or by
+// truncating Config.ResetTables.
+func InjectDB(f func(*TDB)) func(t *testing.T) {
+	return func(t *testing.T) {
+		state.check(t)
+
+		defer state.guardSchema(t)()
+
+		ctx, cncl := context.WithTimeout(context.Background(), state.TestTimeout)
+		defer cncl()
+
+		defer func() {
+			if p := recover(); p != nil {
+				if err := state.reset(); err != nil {
+					t.Logf("reset failed while handling panic: %v", err)
+				}
+				panic(p)
+			}
+			if err := state.reset(); err != nil {
+				t.Errorf("reset on test complete: %v", err)
+			}
+		}()
+		f(&TDB{T: t, DB: state.DB, Ctx: ctx, queriesBefore: atomic.LoadInt64(&totalQueries)})
+	}
+}
+
+func (s *settings) reset() error {
+	ctx, cncl := context.WithTimeout(context.Background(), s.CleanUpTimeout)
+	defer cncl()
+
+	if s.ResetFunc != nil {
+		return s.ResetFunc(ctx, s.DB)
+	}
+	return truncate(ctx, s.DB, s.ResetTables)
+}
+
+func truncate(ctx context.Context, db *sql.DB, tables []string) error {
+	dialect := dialectOf(db)
+	if len(tables) == 0 {
+		var err error
+		if tables, err = listTables(ctx, db, dialect); err != nil {
+			return fmt.Errorf("listing tables: %w", err)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	// foreign key checks are toggled per session, so everything has to happen on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var read, set string
+	switch dialect {
+	case dialectPostgres:
+		// CASCADE takes care of ordering between the tables being truncated
+		_, err := conn.ExecContext(ctx, "TRUNCATE TABLE "+strings.Join(tables, ", ")+" CASCADE")
+		if err != nil {
+			return fmt.Errorf("truncating %v: %w", strings.Join(tables, ", "), err)
+		}
+		return nil
+	case dialectMySQL:
+		read, set = "SELECT @@FOREIGN_KEY_CHECKS", "SET FOREIGN_KEY_CHECKS = "
+	case dialectSQLite:
+		read, set = "PRAGMA foreign_keys", "PRAGMA foreign_keys = "
+	}
+
+	// the checks are restored to what they were rather than enabled, since the session may have had them off
+	var checks int
+	if read != "" {
+		if err := conn.QueryRowContext(ctx, read).Scan(&checks); err != nil {
+			return fmt.Errorf("%v: %w", read, err)
+		}
+		if checks != 0 {
+			if _, err := conn.ExecContext(ctx, set+"0"); err != nil {
+				return fmt.Errorf("%v0: %w", set, err)
+			}
+		}
+	}
+	for _, table := range tables {
+		if _, err = conn.ExecContext(ctx, truncateStatement(dialect, table)); err != nil {
+			err = fmt.Errorf("truncating %v: %w", table, err)
+			break
+		}
+	}
+	// restore the checks even on failure, since the connection goes back to the pool
+	if checks != 0 {
+		if _, restoreErr := conn.ExecContext(ctx, fmt.Sprint(set, checks)); restoreErr != nil && err == nil {
+			err = fmt.Errorf("%v%d: %w", set, checks, restoreErr)
+		}
+	}
+	return err
+}
+
+// TConn is handed to tests run with InjectNoTx.
+type TConn struct {
+	*testing.T
+	Conn *sql.Conn
+	Ctx  context.Context
+}
+
+// InjectNoTx runs f against a dedicated connection outside of any transaction, for statements which can't run inside
+// one, like Postgres's CREATE INDEX CONCURRENTLY. Nothing is rolled back: f is responsible for undoing its changes, or
+// can pass the connection's database to a test run with InjectDB.
+func InjectNoTx(f func(*TConn)) func(t *testing.T) {
+	return func(t *testing.T) {
+		state.check(t)
+
+		defer state.guardSchema(t)()
+
+		ctx, cncl := context.WithTimeout(context.Background(), state.TestTimeout)
+		defer cncl()
+
+		conn, err := state.DB.Conn(ctx)
+		if err != nil {
+			t.Fatalf("db.Conn: %v", err)
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				t.Logf("conn.Close: %v", err)
+			}
+		}()
+		if err := state.prepareConn(ctx, conn); err != nil {
+			t.Fatalf("Config.AfterConnect: %v", err)
+		}
+
+		f(&TConn{T: t, Conn: conn, Ctx: ctx})
+	}
+}
@@ -0,0 +1,102 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// rolledBack runs f with a database whose only connection is one of db's, within a transaction which is rolled back
+// afterwards. Transactions f begins are savepoints within it.
+func rolledBack(ctx context.Context, db *sql.DB, f func(*sql.DB) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("beginning a transaction: %w", err)
+	}
+	defer func() {
+		// not bound by ctx, which may have expired
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+	}()
+
+	return conn.Raw(func(dc interface{}) error {
+		held := sql.OpenDB(heldConnector{heldConn{&wrappedConn{Conn: dc.(driver.Conn)}}, db.Driver()})
+		defer held.Close()
+		held.SetMaxOpenConns(1)
+		return f(held)
+	})
+}
+
+// heldConnector always connects with the same connection.
+type heldConnector struct {
+	conn heldConn
+	drv  driver.Driver
+}
+
+func (c heldConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (c heldConnector) Driver() driver.Driver                        { return c.drv }
+
+// heldConn is a connection which database/sql can't close or reset, since it's still in use by its own database, and
+// whose transactions are savepoints.
+type heldConn struct {
+	*wrappedConn
+}
+
+// savepoints numbers the savepoints begun on heldConns.
+var savepoints int64
+
+func (c heldConn) Close() error                       { return nil }
+func (c heldConn) ResetSession(context.Context) error { return nil }
+
+func (c heldConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c heldConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("dbtesting: transaction options are unsupported within a savepoint")
+	}
+	tx := savepointTx{c, fmt.Sprintf("dbtesting_%d", atomic.AddInt64(&savepoints, 1))}
+	if err := tx.exec(ctx, "SAVEPOINT "+tx.name); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// savepointTx is a transaction within a heldConn's transaction.
+type savepointTx struct {
+	conn heldConn
+	name string
+}
+
+func (tx savepointTx) Commit() error {
+	return tx.exec(context.Background(), "RELEASE SAVEPOINT "+tx.name)
+}
+
+func (tx savepointTx) Rollback() error {
+	if err := tx.exec(context.Background(), "ROLLBACK TO SAVEPOINT "+tx.name); err != nil {
+		return err
+	}
+	return tx.exec(context.Background(), "RELEASE SAVEPOINT "+tx.name)
+}
+
+func (tx savepointTx) exec(ctx context.Context, query string) error {
+	_, err := tx.conn.ExecContext(ctx, query, nil)
+	if !errors.Is(err, driver.ErrSkip) {
+		return err
+	}
+	stmt, err := tx.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
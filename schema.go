@@ -0,0 +1,112 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// guarded tracks the tests being guarded by guardSchema, whose snapshots of the whole database would otherwise blame
+// them for each other's changes when run in parallel.
+var guarded struct {
+	sync.Mutex
+	active   int
+	overlaps uint64
+}
+
+// guardSchema snapshots the schema for Config.GuardSchema, returning a function which fails t if it has changed since.
+func (s *settings) guardSchema(t *testing.T) func() {
+	if !s.GuardSchema || s.SuiteTx != nil {
+		return func() {}
+	}
+
+	guarded.Lock()
+	if guarded.active > 0 {
+		guarded.overlaps++
+	}
+	guarded.active++
+	alone, overlaps := guarded.active == 1, guarded.overlaps
+	guarded.Unlock()
+
+	before, err := snapshotSchema(s.DB, s.CleanUpTimeout)
+	if err != nil {
+		guarded.Lock()
+		guarded.active--
+		guarded.Unlock()
+		t.Fatalf("GuardSchema: %v", err)
+	}
+	return func() {
+		guarded.Lock()
+		guarded.active--
+		alone = alone && guarded.overlaps == overlaps
+		guarded.Unlock()
+		if !alone {
+			t.Log("GuardSchema: not checked, since other tests ran in parallel")
+			return
+		}
+
+		after, err := snapshotSchema(s.DB, s.CleanUpTimeout)
+		if err != nil {
+			t.Errorf("GuardSchema: %v", err)
+			return
+		}
+		if added, removed := diffSets(before, after), diffSets(after, before); len(added)+len(removed) > 0 {
+			t.Errorf("GuardSchema: the test changed the schema; added %v, removed %v", added, removed)
+		}
+	}
+}
+
+func snapshotSchema(db *sql.DB, timeout time.Duration) ([]string, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), timeout)
+	defer cncl()
+
+	var query string
+	switch dialect := dialectOf(db); dialect {
+	case dialectPostgres:
+		query = `SELECT 'table ' || table_name FROM information_schema.tables WHERE table_schema = current_schema()
+UNION ALL SELECT 'index ' || indexname FROM pg_indexes WHERE schemaname = current_schema()`
+	case dialectMySQL:
+		query = `SELECT concat('table ', table_name) FROM information_schema.tables WHERE table_schema = DATABASE()
+UNION SELECT concat('index ', table_name, '.', index_name) FROM information_schema.statistics WHERE table_schema = DATABASE()`
+	case dialectSQLite:
+		query = `SELECT type || ' ' || name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'`
+	default:
+		return nil, fmt.Errorf("unsupported for driver %q", dialect)
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []string
+	for rows.Next() {
+		var o string
+		if err := rows.Scan(&o); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	sort.Strings(objects)
+	return objects, rows.Err()
+}
+
+// diffSets returns the elements of b which aren't in a.
+func diffSets(a, b []string) []string {
+	in := make(map[string]bool, len(a))
+	for _, s := range a {
+		in[s] = true
+	}
+	var diff []string
+	for _, s := range b {
+		if !in[s] {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,31 @@
+package dbtesting
+
+import "fmt"
+
+// ResetSequence sets the next value generated for name to to, so that tests can rely on the IDs they generate. On
+// Postgres name is a sequence, restarted within the test's transaction. On MySQL it's a table whose AUTO_INCREMENT is
+// altered outside the test's transaction, since ALTER TABLE would commit it, so it should be called before the test
+// touches the table. On SQLite it's a table declared with AUTOINCREMENT.
+func (t *T) ResetSequence(name string, to int64) {
+	t.Helper()
+
+	ctx, cncl := t.helperCtx()
+	defer cncl()
+
+	var err error
+	switch t.Driver() {
+	case dialectPostgres:
+		_, err = t.Tx.ExecContext(ctx, fmt.Sprintf("ALTER SEQUENCE %v RESTART WITH %d", name, to))
+	case dialectMySQL:
+		_, err = t.root().db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %v AUTO_INCREMENT = %d", name, to))
+	case dialectSQLite:
+		if _, err = t.Tx.ExecContext(ctx, "DELETE FROM sqlite_sequence WHERE name = ?", name); err == nil {
+			_, err = t.Tx.ExecContext(ctx, "INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)", name, to-1)
+		}
+	default:
+		t.Fatalf("ResetSequence: unsupported for driver %q", t.Driver())
+	}
+	if err != nil {
+		t.Fatalf("ResetSequence: %v: %v", name, err)
+	}
+}
@@ -0,0 +1,233 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+func SQL(query string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		logSQL(ctx, "%v", query)
+		_, err := db.ExecContext(ctx, query)
+		return err
+	}
+}
+
+// SQLArgs is like SQL but passes args to the query, e.g. SQLArgs(`INSERT INTO films (code, title) VALUES ($1, $2)`,
+// code, title), so that values from the test's configuration needn't be formatted into it.
+func SQLArgs(query string, args ...interface{}) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		logSQL(ctx, "%v with args %v", query, args)
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+}
+
+// SQLStatements executes each statement separately, for drivers which don't support several in a single Exec.
+func SQLStatements(stmts ...string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for i, stmt := range stmts {
+			logSQL(ctx, "statement %d: %v", i, stmt)
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("statement %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+}
+
+// SplitStatements splits script on semicolons, ignoring those within quotes, including Postgres' dollar quotes, e.g.
+// the body of $$ ... $$ or $body$ ... $body$, and MySQL's backtick-quoted identifiers, or comments, and drops empty
+// statements. A backslash escapes the next character within single or double quotes, as in MySQL, so a Postgres string
+// ending in a backslash, like 'C:\', must be written as E'C:\\' instead.
+func SplitStatements(script string) []string {
+	var (
+		stmts []string
+		start int
+	)
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			// a doubled quote escapes itself, which this handles as two adjacent quoted sections
+			i = closingQuote(script, i)
+		case c == '$' && (i == 0 || !isIdentByte(script[i-1])) && dollarTag(script[i:]) != "":
+			tag := dollarTag(script[i:])
+			if end := strings.Index(script[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag) - 1
+			} else {
+				i = len(script)
+			}
+		case strings.HasPrefix(script[i:], "--"):
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i:], "*/"); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(script)
+			}
+		case c == ';':
+			stmts = appendStatement(stmts, script[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(script) {
+		stmts = appendStatement(stmts, script[start:])
+	}
+	return stmts
+}
+
+// closingQuote returns the index of the quote closing the one at script[open], or len(script) if it's unterminated.
+func closingQuote(script string, open int) int {
+	q := script[open]
+	for i := open + 1; i < len(script); i++ {
+		switch script[i] {
+		case q:
+			return i
+		case '\\':
+			if q != '`' {
+				i++
+			}
+		}
+	}
+	return len(script)
+}
+
+// dollarTag returns the opening dollar quote, e.g. $$ or $body$, which s starts with, if any. Tags can't start with a
+// digit, which distinguishes them from parameters like $1.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case !isIdentByte(c) || (i == 1 && c >= '0' && c <= '9'):
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func appendStatement(stmts []string, stmt string) []string {
+	if stmt = strings.TrimSpace(stmt); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// SQLFile executes the contents of the file at path, which is read at set up time.
+func SQLFile(path string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %v: %w", path, err)
+		}
+		return execFile(ctx, db, path, b)
+	}
+}
+
+// SQLFS is like SQLFile but reads from fsys, e.g. an embed.FS.
+func SQLFS(fsys fs.FS, name string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("reading %v: %w", name, err)
+		}
+		return execFile(ctx, db, name, b)
+	}
+}
+
+// SQLDir executes each .sql file in dir of fsys, e.g. an embed.FS, in lexical order, so that files named like
+// 001_tables.sql and 002_indexes.sql run in sequence.
+func SQLDir(fsys fs.FS, dir string) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		names, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+		if err != nil {
+			return fmt.Errorf("reading %v: %w", dir, err)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("reading %v: no .sql files", dir)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			b, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return fmt.Errorf("reading %v: %w", name, err)
+			}
+			if err := execFile(ctx, db, name, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func execFile(ctx context.Context, db *sql.DB, name string, contents []byte) error {
+	logSQL(ctx, "%v: %s", name, contents)
+	if _, err := db.ExecContext(ctx, string(contents)); err != nil {
+		return fmt.Errorf("executing %v: %w", name, err)
+	}
+	return nil
+}
+
+// logSQL logs a statement about to be executed when Config.Verbose is set in the settings ctx is being set up under.
+func logSQL(ctx context.Context, format string, args ...interface{}) {
+	if s := settingsOf(ctx); s.Verbose && s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// settingsKey keys the settings a database is being set up under in the contexts given to SetUpFunc and the other
+// hooks, which are the package's own unless set up by Validate.
+type settingsKey struct{}
+
+func withSettings(ctx context.Context, s *settings) context.Context {
+	return context.WithValue(ctx, settingsKey{}, s)
+}
+
+func settingsOf(ctx context.Context) *settings {
+	if s, ok := ctx.Value(settingsKey{}).(*settings); ok {
+		return s
+	}
+	return &state
+}
+
+// Chain runs each of fns in order, stopping at the first error.
+func Chain(fns ...func(context.Context, *sql.DB) error) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for i, f := range fns {
+			if err := f(ctx, db); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+}
+
+// ChainCleanUp runs each of fns in reverse order, so that it can mirror a Chain of set up functions. Unlike Chain, it
+// continues past errors and returns them all combined.
+func ChainCleanUp(fns ...func(context.Context, *sql.DB) error) func(context.Context, *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		var errs []error
+		for i := len(fns) - 1; i >= 0; i-- {
+			if err := fns[i](ctx, db); err != nil {
+				errs = append(errs, fmt.Errorf("step %d: %w", i, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,124 @@
+package dbtesting_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestSQLFileMissing(t *testing.T) {
+	err := dbtesting.SQLFile("testdata/missing.sql")(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "testdata/missing.sql") {
+		t.Fatalf("expected an error naming the missing file but got %v", err)
+	}
+
+	err = dbtesting.SQLFS(fstest.MapFS{}, "schema.sql")(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "schema.sql") {
+		t.Fatalf("expected an error naming the missing file but got %v", err)
+	}
+}
+
+func TestSQLDirEmpty(t *testing.T) {
+	fsys := fstest.MapFS{"schema/README.md": {Data: []byte("not sql")}}
+	err := dbtesting.SQLDir(fsys, "schema")(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "no .sql files") {
+		t.Fatalf("expected an error about the empty directory but got %v", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []int
+	step := func(i int, err error) func(context.Context, *sql.DB) error {
+		return func(context.Context, *sql.DB) error {
+			calls = append(calls, i)
+			return err
+		}
+	}
+
+	err := dbtesting.Chain(step(0, nil), step(1, errors.New("boom")), step(2, nil))(context.Background(), nil)
+	if err == nil || err.Error() != "step 1: boom" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(calls, []int{0, 1}) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+
+	calls = nil
+	err = dbtesting.ChainCleanUp(step(0, errors.New("first")), step(1, nil), step(2, errors.New("last")))(context.Background(), nil)
+	if err == nil || err.Error() != "step 2: last\nstep 0: first" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(calls, []int{2, 1, 0}) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `
+CREATE TABLE films (code char(5), title varchar(40)); -- a comment; with a semicolon
+INSERT INTO films VALUES ('abcde', 'semi;colon''s');
+/* another; comment */ INSERT INTO "odd;name" VALUES (1);
+CREATE FUNCTION one() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;
+CREATE FUNCTION two() RETURNS int AS $body$ BEGIN RETURN $$;$$::int; END; $body$ LANGUAGE plpgsql;
+SELECT $1, a$b FROM films;
+`
+	expected := []string{
+		`CREATE TABLE films (code char(5), title varchar(40))`,
+		"-- a comment; with a semicolon\nINSERT INTO films VALUES ('abcde', 'semi;colon''s')",
+		`/* another; comment */ INSERT INTO "odd;name" VALUES (1)`,
+		`CREATE FUNCTION one() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql`,
+		`CREATE FUNCTION two() RETURNS int AS $body$ BEGIN RETURN $$;$$::int; END; $body$ LANGUAGE plpgsql`,
+		`SELECT $1, a$b FROM films`,
+	}
+	if stmts := dbtesting.SplitStatements(script); !reflect.DeepEqual(stmts, expected) {
+		t.Fatalf("expected %#v but got %#v", expected, stmts)
+	}
+}
+
+func TestSplitStatementsMySQL(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		script   string
+		expected []string
+	}{
+		{"escaped single quote", `INSERT INTO films VALUES ('it\'s; fine'); SELECT 1`, []string{`INSERT INTO films VALUES ('it\'s; fine')`, `SELECT 1`}},
+		{"escaped double quote", `INSERT INTO films VALUES ("say \"hi; there\""); SELECT 1`, []string{`INSERT INTO films VALUES ("say \"hi; there\"")`, `SELECT 1`}},
+		{"escaped backslash", `INSERT INTO films VALUES ('C:\\'); SELECT 1`, []string{`INSERT INTO films VALUES ('C:\\')`, `SELECT 1`}},
+		{"backticks", "CREATE TABLE `a;b` (`c;d` int); SELECT 1", []string{"CREATE TABLE `a;b` (`c;d` int)", `SELECT 1`}},
+		{"doubled backticks", "CREATE TABLE `a``;b` (c int); SELECT 1", []string{"CREATE TABLE `a``;b` (c int)", `SELECT 1`}},
+		{"backslash in backticks", "CREATE TABLE `a\\` (c int); SELECT 1", []string{"CREATE TABLE `a\\` (c int)", `SELECT 1`}},
+	} {
+		if stmts := dbtesting.SplitStatements(c.script); !reflect.DeepEqual(stmts, c.expected) {
+			t.Errorf("%v: expected %#v but got %#v", c.name, c.expected, stmts)
+		}
+	}
+}
+
+func TestSQLiteMemoryWithoutDriver(t *testing.T) {
+	if _, err := dbtesting.SQLiteMemory()(); err == nil {
+		t.Fatal("expected an error without a SQLite driver registered")
+	}
+}
+
+func TestSQLArgs(t *testing.T) {
+	t.Run("args", dbtesting.InjectDB(func(t *dbtesting.TDB) {
+		insert := dbtesting.SQLArgs(`INSERT INTO films (code, title, did) VALUES ($1, $2, $3);`, "abcde", "it's quoted", 1)
+		if err := insert(t.Ctx, t.DB); err != nil {
+			t.Fatalf("SQLArgs: %v", err)
+		}
+
+		var title string
+		if err := t.DB.QueryRowContext(t.Ctx, `SELECT title FROM films WHERE code = 'abcde';`).Scan(&title); err != nil {
+			t.Fatalf("error querying: %v", err)
+		}
+		if title != "it's quoted" {
+			t.Fatalf("expected the title to be passed through but got %q", title)
+		}
+	}))
+}
@@ -0,0 +1,35 @@
+//go:build go1.21
+
+package dbtesting
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Slog adapts l for Config.Logger, so that set up, clean up and connection events are logged as structured records
+// with fields like duration, driver and error. It requires Go 1.21.
+func Slog(l *slog.Logger) *SlogLogger {
+	return &SlogLogger{l: l}
+}
+
+// SlogLogger logs through a *slog.Logger; see Slog.
+type SlogLogger struct {
+	l *slog.Logger
+}
+
+// Printf logs messages which aren't events at the info level.
+func (s *SlogLogger) Printf(format string, v ...interface{}) {
+	s.l.Info(fmt.Sprintf(format, v...))
+}
+
+func (s *SlogLogger) logFields(msg string, fields []interface{}) {
+	level := slog.LevelInfo
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] == "error" {
+			level = slog.LevelError
+		}
+	}
+	s.l.Log(context.Background(), level, msg, fields...)
+}
@@ -0,0 +1,28 @@
+//go:build go1.21
+
+package dbtesting
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	var buf strings.Builder
+	l := Slog(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	logEvent(l, "CleanUpFunc failed", []interface{}{"driver", dialectPostgres, "error", errors.New("boom")}, "%v", "boom")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(buf.String()), &record); err != nil {
+		t.Fatalf("decoding %q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]interface{}{"msg": "CleanUpFunc failed", "level": "ERROR", "driver": "postgres", "error": "boom"} {
+		if record[k] != v {
+			t.Errorf("expected %v to be %v but got %v", k, v, record[k])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package dbtesting
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// sqliteDrivers are the names registered by common SQLite drivers, e.g. github.com/mattn/go-sqlite3 and
+// modernc.org/sqlite.
+var sqliteDrivers = []string{"sqlite3", "sqlite"}
+
+// SQLiteMemory returns a ConnectFunc opening a fresh in-memory SQLite database with whichever SQLite driver the tests
+// import, for running without a database server. The database lives only as long as a connection to it, so the pool
+// keeps an idle connection open for as long as it's open itself.
+//
+// Its connections share SQLite's cache, which locks tables rather than the database: a connection writing while
+// another's transaction holds the table, e.g. tests running in parallel or a test's NewTx, fails at once with
+// SQLITE_LOCKED, which busy timeouts don't retry. Set Config.MaxOpenConns to 1 to serialize them on one connection
+// instead. A busy timeout, e.g. mattn/go-sqlite3's _busy_timeout=5000, with its _txlock=immediate, or
+// modernc.org/sqlite's _pragma=busy_timeout(5000), only helps a file database opened by DSN without the shared cache.
+func SQLiteMemory() func() (*sql.DB, error) {
+	return func() (*sql.DB, error) {
+		registered := make(map[string]bool)
+		for _, d := range sql.Drivers() {
+			registered[d] = true
+		}
+
+		for _, d := range sqliteDrivers {
+			if !registered[d] {
+				continue
+			}
+			name, err := uniqueName("dbtesting")
+			if err != nil {
+				return nil, err
+			}
+			db, err := sql.Open(d, fmt.Sprintf("file:%v?mode=memory&cache=shared", name))
+			if err != nil {
+				return nil, err
+			}
+			db.SetMaxIdleConns(1)
+			db.SetConnMaxLifetime(0)
+			db.SetConnMaxIdleTime(0)
+			return db, nil
+		}
+		return nil, errors.New("SQLiteMemory: no SQLite driver is registered; import one, e.g. modernc.org/sqlite")
+	}
+}
@@ -0,0 +1,56 @@
+// Package sqlxtesting adapts dbtesting's injected transactions to sqlx.
+package sqlxtesting
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jwilner/dbtesting"
+)
+
+type T struct {
+	*dbtesting.T
+	Tx *sqlx.Tx
+}
+
+// Inject is like dbtesting.Inject, but hands f the same transaction wrapped by sqlx, which is rolled back as usual.
+// Tests dedicated a connection by Config.PerTestConn or Config.AfterConnect, which Config.IsolateSchema sets for
+// connections it doesn't open, fail, as sqlx can't begin on one, as do tests under Config.SuiteTransaction, whose
+// transaction sqlx didn't begin.
+func Inject(f func(*T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		var tx *sqlx.Tx
+		dbtesting.InjectWith(dbtesting.TestConfig{
+			BeginTx: func(ctx context.Context, db *sql.DB, opts *sql.TxOptions) (*sql.Tx, error) {
+				var err error
+				if tx, err = sqlx.NewDb(db, driverName(db)).BeginTxx(ctx, opts); err != nil {
+					return nil, err
+				}
+				return tx.Tx, nil
+			},
+		}, func(t *dbtesting.T) {
+			if tx == nil {
+				t.Fatal(unsupported(t))
+			}
+			f(&T{T: t, Tx: tx})
+		})(t)
+	}
+}
+
+// unsupported explains why t's transaction wasn't begun by sqlx.
+func unsupported(t *dbtesting.T) string {
+	if t.Conn != nil {
+		return "sqlxtesting: unsupported with Config.PerTestConn or Config.AfterConnect, which Config.IsolateSchema sets"
+	}
+	return "sqlxtesting: unsupported with Config.SuiteTransaction"
+}
+
+// driverName names db's driver as sqlx does, which determines its bind variable style.
+func driverName(db *sql.DB) string {
+	if d := dbtesting.Dialect(db); d != "sqlite" {
+		return d
+	}
+	return "sqlite3"
+}
@@ -0,0 +1,24 @@
+package sqlxtesting
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/jwilner/dbtesting"
+)
+
+func TestUnsupported(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		t        *dbtesting.T
+		expected string
+	}{
+		{"dedicated connection", &dbtesting.T{Conn: &sql.Conn{}}, "Config.AfterConnect"},
+		{"suite transaction", &dbtesting.T{}, "Config.SuiteTransaction"},
+	} {
+		if msg := unsupported(c.t); !strings.Contains(msg, c.expected) {
+			t.Errorf("%v: expected %q to name %v", c.name, msg, c.expected)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package sqlxtesting_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jwilner/dbtesting"
+	"github.com/jwilner/dbtesting/sqlxtesting"
+
+	// include PQ postgres driver
+	_ "github.com/lib/pq"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(dbtesting.RunTests(m, dbtesting.Config{
+		SetUpFunc: dbtesting.SQL(`
+CREATE TABLE sqlx_films (
+    code        char(5) CONSTRAINT sqlx_firstkey PRIMARY KEY,
+    title       varchar(40) NOT NULL
+);
+`),
+		CleanUpFunc: dbtesting.SQL(`
+DROP TABLE sqlx_films;
+`),
+	}))
+}
+
+func TestInject(t *testing.T) {
+	type film struct {
+		Code  string `db:"code"`
+		Title string `db:"title"`
+	}
+
+	t.Run("named", sqlxtesting.Inject(func(t *sqlxtesting.T) {
+		if _, err := t.Tx.NamedExecContext(t.Ctx, `INSERT INTO sqlx_films (code, title) VALUES (:code, :title);`, film{"abcde", "title"}); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+
+		var f film
+		if err := t.Tx.GetContext(t.Ctx, &f, `SELECT code, title FROM sqlx_films WHERE code = $1;`, "abcde"); err != nil {
+			t.Fatalf("error getting: %v", err)
+		}
+		if f != (film{"abcde", "title"}) {
+			t.Fatalf("unexpected film: %v", f)
+		}
+	}))
+}
@@ -0,0 +1,47 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// Strategy is how tests run with Inject are isolated from each other, so that the same tests can run against
+// databases which call for different approaches.
+type Strategy string
+
+const (
+	// StrategyTransaction rolls back each test's transactions. It's the default.
+	StrategyTransaction Strategy = "transaction"
+	// StrategyTruncate commits each passing test's transactions and then resets the database as InjectDB does, with
+	// Config.ResetFunc or by truncating Config.ResetTables.
+	StrategyTruncate Strategy = "truncate"
+	// StrategyFreshDatabase begins each test's transactions on a new database cloned from the template built by
+	// Config.TemplateSetUpFunc, as InjectFreshDB does, and drops it afterwards.
+	StrategyFreshDatabase Strategy = "fresh"
+)
+
+func parseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case StrategyTransaction, StrategyTruncate, StrategyFreshDatabase:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown strategy %q; expected %q, %q or %q", s, StrategyTransaction, StrategyTruncate, StrategyFreshDatabase)
+}
+
+// strategyDB returns the database a test's transactions are begun on under Config.Strategy, along with a function to
+// run once they've ended.
+func (s *settings) strategyDB(ctx context.Context, t *testing.T) (*sql.DB, func(), error) {
+	switch s.Strategy {
+	case StrategyTruncate:
+		return s.DB, func() {
+			if err := s.reset(); err != nil {
+				t.Errorf("reset on test complete: %v", err)
+			}
+		}, nil
+	case StrategyFreshDatabase:
+		return s.freshDB(ctx, t)
+	}
+	return s.DB, func() {}, nil
+}
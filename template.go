@@ -0,0 +1,108 @@
+package dbtesting
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// InjectFreshDB runs f against a new Postgres database cloned from the template built by Config.TemplateSetUpFunc, so
+// that code under test is free to commit. The database is dropped once f returns.
+func InjectFreshDB(f func(*TDB)) func(t *testing.T) {
+	return func(t *testing.T) {
+		state.check(t)
+		if state.Template == "" {
+			t.Fatal("InjectFreshDB: Config.TemplateSetUpFunc must be set")
+		}
+
+		ctx, cncl := context.WithTimeout(context.Background(), state.TestTimeout)
+		defer cncl()
+
+		db, done, err := state.freshDB(ctx, t)
+		if err != nil {
+			t.Fatalf("InjectFreshDB: %v", err)
+		}
+		defer done()
+
+		f(&TDB{T: t, DB: db, Ctx: ctx, queriesBefore: atomic.LoadInt64(&totalQueries)})
+	}
+}
+
+// freshDB clones the template into a new database, returning a connection to it and a function which closes the
+// connection and drops the database.
+func (s *settings) freshDB(ctx context.Context, t *testing.T) (*sql.DB, func(), error) {
+	name, err := uniqueName("dbtesting_")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.DB.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %v TEMPLATE %v", name, s.Template)); err != nil {
+		return nil, nil, fmt.Errorf("creating %v: %w", name, err)
+	}
+	drop := func() {
+		if err := dropDatabase(s.DB, name, s.CleanUpTimeout); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	db, err := s.ConnectDatabaseFunc(name)
+	if err != nil {
+		drop()
+		return nil, nil, fmt.Errorf("connecting to %v: %w", name, err)
+	}
+	return db, func() {
+		if err := db.Close(); err != nil {
+			t.Logf("db.Close: %v", err)
+		}
+		drop()
+	}, nil
+}
+
+// createTemplate creates a database and sets it up, closing the connection afterwards as Postgres refuses to clone a
+// database while anyone is connected to it.
+func createTemplate(ctx context.Context, db *sql.DB, cfg Config) (string, error) {
+	name, err := uniqueName("dbtesting_template_")
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE "+name); err != nil {
+		return "", fmt.Errorf("creating %v: %w", name, err)
+	}
+
+	tmpl, err := cfg.ConnectDatabaseFunc(name)
+	if err == nil {
+		err = cfg.TemplateSetUpFunc(ctx, tmpl)
+		if cErr := tmpl.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if err != nil {
+		if dErr := dropDatabase(db, name, cfg.CleanUpTimeout); dErr != nil {
+			cfg.Logger.Printf("%v", dErr)
+		}
+		return "", fmt.Errorf("setting up %v: %w", name, err)
+	}
+	return name, nil
+}
+
+func dropDatabase(db *sql.DB, name string, timeout time.Duration) error {
+	ctx, cncl := context.WithTimeout(context.Background(), timeout)
+	defer cncl()
+
+	if _, err := db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+name); err != nil {
+		return fmt.Errorf("dropping %v: %w", name, err)
+	}
+	return nil
+}
+
+func uniqueName(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
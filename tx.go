@@ -0,0 +1,94 @@
+package dbtesting
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Tx wraps the transaction injected into each test, recording the queries passed through it. Statements bound to it
+// with Stmt or StmtContext aren't recorded, since their query isn't known; prepare them with Prepare instead. Those run
+// on t.Tx itself are recorded by the test's connection, when this package opened it.
+type Tx struct {
+	*sql.Tx
+
+	mu      sync.Mutex
+	queries []string
+	attempt *attempt
+}
+
+// check abandons the current attempt at running the test if err is retriable and it has attempts to spare.
+func (tx *Tx) check(err error) {
+	if err != nil && tx.attempt != nil && tx.attempt.retriable && tx.attempt.isRetriable(err) {
+		tx.attempt.err = err
+		panic(tx.attempt)
+	}
+}
+
+// recorderKey keys the Tx a connection records the statements of a test's transaction to, in the context beginning it.
+type recorderKey struct{}
+
+// unrecordedKey marks the contexts of statements run by this package, or already recorded by Tx, which the connection
+// shouldn't record.
+type unrecordedKey struct{}
+
+func unrecorded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unrecordedKey{}, true)
+}
+
+func (tx *Tx) record(query string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.queries = append(tx.queries, query)
+}
+
+// Queries returns the queries executed, queried or prepared through tx, in order.
+func (tx *Tx) Queries() []string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return append([]string(nil), tx.queries...)
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tx.record(query)
+	res, err := tx.Tx.ExecContext(unrecorded(ctx), query, args...)
+	tx.check(err)
+	return res, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	tx.record(query)
+	rows, err := tx.Tx.QueryContext(unrecorded(ctx), query, args...)
+	tx.check(err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	tx.record(query)
+	row := tx.Tx.QueryRowContext(unrecorded(ctx), query, args...)
+	tx.check(row.Err())
+	return row
+}
+
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.PrepareContext(context.Background(), query)
+}
+
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	tx.record(query)
+	stmt, err := tx.Tx.PrepareContext(unrecorded(ctx), query)
+	tx.check(err)
+	return stmt, err
+}